@@ -0,0 +1,450 @@
+package archive
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/thenrich/go-surv/video"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record describes a recorded segment in the catalog
+type Record struct {
+	// Segment ID, unique across cameras
+	ID string `json:"id"`
+
+	// Camera that recorded the segment
+	Camera string `json:"camera"`
+
+	// Wall-clock time span of the segment
+	Start    time.Time     `json:"start"`
+	End      time.Time     `json:"end"`
+	Duration time.Duration `json:"duration"`
+
+	// Size of the file in bytes
+	Size int64 `json:"size"`
+
+	// Name of the video codec
+	Codec string `json:"codec"`
+
+	// Path of the local copy, empty if there is none
+	LocalPath string `json:"localPath,omitempty"`
+
+	// Object key of the archived copy, empty if there is none
+	RemoteKey string `json:"remoteKey,omitempty"`
+
+	// Hex encoded SHA-256 of the file
+	Checksum string `json:"checksum"`
+}
+
+// Local returns true if the segment is available on local disk
+func (r *Record) Local() bool {
+	return r.LocalPath != ""
+}
+
+// Remote returns true if the segment is archived with a cloud provider
+func (r *Record) Remote() bool {
+	return r.RemoteKey != ""
+}
+
+// journal entry, each line in the catalog file is one entry
+type entry struct {
+	Op     string  `json:"op"`
+	ID     string  `json:"id,omitempty"`
+	Record *Record `json:"record,omitempty"`
+}
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// compactMinEntries is the number of journal entries appended before the
+// journal is compacted while the catalog is open. It's compacted once it
+// also holds more than twice as many entries as there are records.
+const compactMinEntries = 1000
+
+// Catalog is an on-disk index of recorded segments. Changes are appended
+// to a journal file that is replayed and compacted when the catalog is
+// opened, and compacted again as it grows.
+type Catalog struct {
+	mu sync.RWMutex
+
+	path    string
+	f       *os.File
+	records map[string]*Record
+
+	// entries appended since the journal was last compacted
+	appended int
+}
+
+// Recorded adds a finalized local segment to the catalog
+func (c *Catalog) Recorded(seg *video.Segment) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := c.record(seg)
+	r.LocalPath = seg.Path
+
+	return c.put(r)
+}
+
+// Uploaded marks a segment as archived under key. The local copy is
+// dropped from the record once it no longer exists on disk.
+func (c *Catalog) Uploaded(seg *video.Segment, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := c.record(seg)
+	r.RemoteKey = key
+	if _, err := os.Stat(r.LocalPath); os.IsNotExist(err) {
+		r.LocalPath = ""
+	}
+
+	return c.put(r)
+}
+
+// record returns a copy of the catalog record for seg, created from the
+// segment if it isn't known yet
+func (c *Catalog) record(seg *video.Segment) *Record {
+	r := &Record{ID: seg.ID(), Camera: seg.Camera, Start: seg.Start}
+	if existing, ok := c.records[r.ID]; ok {
+		*r = *existing
+	}
+
+	if !seg.End.IsZero() {
+		r.End = seg.End
+		r.Duration = seg.Duration()
+	}
+	if seg.Size > 0 {
+		r.Size = seg.Size
+	}
+	if seg.Codec != "" {
+		r.Codec = seg.Codec
+	}
+	if seg.Checksum != "" {
+		r.Checksum = seg.Checksum
+	}
+	if r.LocalPath == "" {
+		r.LocalPath = seg.Path
+	}
+
+	return r
+}
+
+// RemovedLocal drops the local copy of a segment from the catalog. The
+// record is deleted once no copy remains.
+func (c *Catalog) RemovedLocal(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	existing, ok := c.records[id]
+	if !ok {
+		return nil
+	}
+
+	r := *existing
+	r.LocalPath = ""
+	if !r.Remote() {
+		return c.delete(id)
+	}
+
+	return c.put(&r)
+}
+
+// RemovedRemote drops the archived copy of a segment from the catalog. The
+// record is deleted once no copy remains.
+func (c *Catalog) RemovedRemote(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	existing, ok := c.records[id]
+	if !ok {
+		return nil
+	}
+
+	r := *existing
+	r.RemoteKey = ""
+	if !r.Local() {
+		return c.delete(id)
+	}
+
+	return c.put(&r)
+}
+
+// Get returns a copy of the record with the given ID, or nil
+func (c *Catalog) Get(id string) *Record {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	r, ok := c.records[id]
+	if !ok {
+		return nil
+	}
+
+	cp := *r
+	return &cp
+}
+
+// Find returns copies of the records of a camera overlapping the time
+// range [from, to), oldest first. Segments without a known end are
+// treated as instantaneous.
+func (c *Catalog) Find(camera string, from time.Time, to time.Time) []*Record {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var found []*Record
+	for _, r := range c.records {
+		if r.Camera != camera {
+			continue
+		}
+
+		end := r.End
+		if end.IsZero() {
+			end = r.Start
+		}
+
+		if !r.Start.Before(to) || !end.After(from) {
+			continue
+		}
+
+		cp := *r
+		found = append(found, &cp)
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Start.Before(found[j].Start)
+	})
+
+	return found
+}
+
+// put stores a record and appends it to the journal
+func (c *Catalog) put(r *Record) error {
+	c.records[r.ID] = r
+
+	return c.append(&entry{Op: opPut, Record: r})
+}
+
+// delete removes a record and appends the removal to the journal
+func (c *Catalog) delete(id string) error {
+	delete(c.records, id)
+
+	return c.append(&entry{Op: opDelete, ID: id})
+}
+
+func (c *Catalog) append(e *entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "error encoding catalog entry")
+	}
+
+	if _, err := c.f.Write(append(b, '\n')); err != nil {
+		return errors.Wrapf(err, "error writing %s", c.path)
+	}
+
+	if err := c.f.Sync(); err != nil {
+		return errors.Wrapf(err, "error syncing %s", c.path)
+	}
+
+	c.appended++
+	if c.appended >= compactMinEntries && c.appended > 2*len(c.records) {
+		// the entry is already safe in the journal
+		if err := c.compact(); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
+
+// load replays the journal
+func (c *Catalog) load() error {
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "error opening %s", c.path)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// a torn final line after a crash
+			continue
+		}
+
+		switch e.Op {
+		case opPut:
+			if e.Record != nil {
+				c.records[e.Record.ID] = e.Record
+			}
+		case opDelete:
+			delete(c.records, e.ID)
+		}
+	}
+
+	return errors.Wrapf(scanner.Err(), "error reading %s", c.path)
+}
+
+// compact rewrites the journal with one entry per record and reopens it
+// for appending
+func (c *Catalog) compact() error {
+	tmp := c.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrapf(err, "error creating %s", tmp)
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range c.records {
+		if err := enc.Encode(&entry{Op: opPut, Record: r}); err != nil {
+			f.Close()
+			return errors.Wrap(err, "error encoding catalog entry")
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "error writing %s", tmp)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "error syncing %s", tmp)
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, c.path); err != nil {
+		return errors.Wrapf(err, "error replacing %s", c.path)
+	}
+
+	nf, err := os.OpenFile(c.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "error opening %s", c.path)
+	}
+
+	if c.f != nil {
+		c.f.Close()
+	}
+	c.f = nf
+	c.appended = 0
+
+	return nil
+}
+
+// Scan reconciles the catalog with the segments under storagePath, one
+// directory per camera. Segments that were never cataloged, e.g. the ones
+// being recorded when the process stopped, are added, and local copies
+// that no longer exist are dropped. It's meant to run before recording
+// starts.
+func (c *Catalog) Scan(storagePath string) error {
+	dirs, err := ioutil.ReadDir(storagePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "error reading %s", storagePath)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, r := range c.records {
+		if !r.Local() || !isUnder(storagePath, r.LocalPath) {
+			continue
+		}
+		if _, err := os.Stat(r.LocalPath); !os.IsNotExist(err) {
+			continue
+		}
+
+		cp := *r
+		cp.LocalPath = ""
+		if cp.Remote() {
+			err = c.put(&cp)
+		} else {
+			err = c.delete(r.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+
+		name := d.Name()
+		segments, err := video.ListSegments(video.SegmentDir(storagePath, name), name)
+		if err != nil {
+			return err
+		}
+
+		for _, seg := range segments {
+			if _, ok := c.records[seg.ID()]; ok {
+				continue
+			}
+
+			if err := seg.Stat(); err != nil {
+				log.Println(errors.Wrap(err, "error reading uncataloged segment"))
+				continue
+			}
+
+			// fragmented segments are written up to the last packet
+			if fi, err := os.Stat(seg.Path); err == nil && fi.ModTime().After(seg.Start) {
+				seg.End = fi.ModTime().UTC()
+			}
+
+			r := c.record(seg)
+			r.LocalPath = seg.Path
+			if err := c.put(r); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// isUnder returns true if path is inside dir
+func isUnder(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Close closes the journal
+func (c *Catalog) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.f.Close()
+}
+
+// OpenCatalog opens the catalog stored at path, creating it if needed
+func OpenCatalog(path string) (*Catalog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Wrapf(err, "error creating %s", filepath.Dir(path))
+	}
+
+	c := &Catalog{path: path, records: make(map[string]*Record)}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	if err := c.compact(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
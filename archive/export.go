@@ -0,0 +1,466 @@
+package archive
+
+import (
+	"github.com/3d0c/gmf"
+	"github.com/pkg/errors"
+	"github.com/thenrich/go-surv/video"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// ErrNoFootage is returned when no recording covers the requested time range
+var ErrNoFootage = errors.New("no footage for the requested time range")
+
+// Fetcher defines the interface for downloading archived segments from a
+// cloud provider
+type Fetcher interface {
+	DownloadFile(w io.WriterAt, key string) error
+}
+
+// Exporter stitches the recorded segments of a camera into a single clip
+type Exporter struct {
+	catalog *Catalog
+
+	// optional cloud archive segments are fetched from when they are no
+	// longer on local disk
+	remote Fetcher
+}
+
+// SetRemote enables fetching segments archived with a cloud provider
+func (e *Exporter) SetRemote(remote Fetcher) {
+	e.remote = remote
+}
+
+// Export writes an MP4 to dst covering the footage of a camera between from
+// and to. Packets are copied without re-encoding, so the clip starts at the
+// last keyframe at or before from and ends before the first keyframe at or
+// after to.
+func (e *Exporter) Export(camera string, from time.Time, to time.Time, dst string) error {
+	if !from.Before(to) {
+		return errors.New("start of clip must be before its end")
+	}
+
+	records := e.catalog.Find(camera, from, to)
+	if len(records) == 0 {
+		return ErrNoFootage
+	}
+
+	clip := &clipWriter{path: dst, from: from, to: to}
+	defer clip.release()
+
+	for _, r := range records {
+		path, cleanup, err := e.fetch(r)
+		if err != nil {
+			return err
+		}
+
+		done, err := clip.copySegment(r, path)
+		cleanup()
+		if err != nil {
+			return errors.Wrapf(err, "error copying segment %s", r.ID)
+		}
+
+		if done {
+			break
+		}
+	}
+
+	if !clip.started {
+		return ErrNoFootage
+	}
+
+	return clip.finish()
+}
+
+// fetch returns a local path for a segment, downloading it if needed. The
+// returned cleanup function removes any temporary copy.
+func (e *Exporter) fetch(r *Record) (string, func(), error) {
+	if r.Local() {
+		if _, err := os.Stat(r.LocalPath); err == nil {
+			return r.LocalPath, func() {}, nil
+		}
+	}
+
+	if !r.Remote() || e.remote == nil {
+		return "", nil, errors.Errorf("segment %s is not available", r.ID)
+	}
+
+	f, err := ioutil.TempFile("", r.ID+"-")
+	if err != nil {
+		return "", nil, errors.Wrap(err, "error creating temporary file")
+	}
+	cleanup := func() {
+		os.Remove(f.Name())
+	}
+
+	err = e.remote.DownloadFile(f, r.RemoteKey)
+	f.Close()
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return f.Name(), cleanup, nil
+}
+
+// NewExporter creates an exporter for the segments in catalog
+func NewExporter(catalog *Catalog) *Exporter {
+	return &Exporter{catalog: catalog}
+}
+
+// bufferedPacket is a packet read ahead of the start of the clip, along
+// with the segment it was read from
+type bufferedPacket struct {
+	pkt  *gmf.Packet
+	wall time.Time
+	st   *segmentState
+}
+
+// segmentState maps the timestamps of one stream of a source segment onto
+// the clip. It outlives the segment's input context while packets are
+// buffered.
+type segmentState struct {
+	tb    gmf.AVRational
+	start time.Time
+
+	// output stream the packets are written to
+	track *clipTrack
+
+	// first timestamp in the segment, in the source time base
+	first int64
+
+	// offset added to rescaled timestamps, video.NoPTS until the first packet
+	// of the segment is written
+	base int64
+}
+
+// wall returns the wall-clock time of a timestamp in the segment
+func (st *segmentState) wall(ts int64) time.Time {
+	tb := st.tb.AVR()
+	return st.start.Add(time.Duration(float64(ts-st.first) * float64(tb.Num) / float64(tb.Den) * float64(time.Second)))
+}
+
+// clipTrack is an output stream of the clip
+type clipTrack struct {
+	ost *gmf.Stream
+
+	// last timestamp written, in the output time base
+	lastDts int64
+}
+
+// clipWriter muxes packets from consecutive segments into a single file
+type clipWriter struct {
+	path     string
+	from, to time.Time
+
+	ctx   *gmf.FmtCtx
+	video *clipTrack
+
+	// audio of the first segment, nil if it has none
+	audio *clipTrack
+
+	// codec parameters of the clip, segments that differ are skipped
+	codecID, width, height int
+
+	// codec of the clip's audio, segments that differ are copied without
+	// audio
+	audioCodecID int
+
+	// GOP preceding the start of the clip
+	pending []bufferedPacket
+
+	// wall-clock time of the first packet in the clip
+	start   time.Time
+	started bool
+}
+
+// open creates the output file with streams matching ist and the optional
+// audio stream aist
+func (c *clipWriter) open(ist *gmf.Stream, aist *gmf.Stream) error {
+	ctx, err := gmf.NewOutputCtx(c.path, []gmf.Option{{Key: "movflags", Val: "faststart"}})
+	if err != nil {
+		return errors.Wrapf(err, "error creating %s", c.path)
+	}
+
+	ost, err := addClipStream(ctx, ist)
+	if err != nil {
+		ctx.Free()
+		return err
+	}
+
+	var aost *gmf.Stream
+	if aist != nil {
+		if aost, err = addClipStream(ctx, aist); err != nil {
+			ctx.Free()
+			return err
+		}
+	}
+
+	if err := ctx.WriteHeader(); err != nil {
+		ctx.Free()
+		return errors.Wrap(err, "error writing header")
+	}
+
+	par := ist.GetCodecPar()
+	c.ctx = ctx
+	c.video = &clipTrack{ost: ost, lastDts: video.NoPTS}
+	c.codecID = par.GetCodecId()
+	c.width = par.GetWidth()
+	c.height = par.GetHeight()
+
+	if aost != nil {
+		c.audio = &clipTrack{ost: aost, lastDts: video.NoPTS}
+		c.audioCodecID = aist.GetCodecPar().GetCodecId()
+	}
+
+	return nil
+}
+
+// addClipStream adds an output stream copying ist to ctx
+func addClipStream(ctx *gmf.FmtCtx, ist *gmf.Stream) (*gmf.Stream, error) {
+	ost := ctx.NewStream(nil)
+	if ost == nil {
+		return nil, errors.Errorf("error creating output stream for %s", ctx.Filename)
+	}
+
+	if err := ost.CopyCodecPar(ist.GetCodecPar()); err != nil {
+		return nil, errors.Wrap(err, "error copying codec parameters")
+	}
+	ost.SetTimeBase(ist.TimeBase().AVR())
+
+	return ost, nil
+}
+
+// copySegment copies the packets of a segment that fall inside the clip.
+// It returns true once the end of the clip has been reached.
+func (c *clipWriter) copySegment(r *Record, path string) (bool, error) {
+	ictx, err := gmf.NewInputCtx(path)
+	if err != nil {
+		return false, errors.Wrapf(err, "error opening %s", path)
+	}
+	defer ictx.Free()
+
+	ist, err := ictx.GetBestStream(gmf.AVMEDIA_TYPE_VIDEO)
+	if err != nil {
+		return false, errors.Wrapf(err, "error finding stream in %s", path)
+	}
+
+	// segments without audio are copied as they are
+	aist, err := ictx.GetBestStream(gmf.AVMEDIA_TYPE_AUDIO)
+	if err != nil {
+		aist = nil
+	}
+
+	if c.ctx == nil {
+		if err := c.open(ist, aist); err != nil {
+			return false, err
+		}
+	} else if par := ist.GetCodecPar(); par.GetCodecId() != c.codecID || par.GetWidth() != c.width || par.GetHeight() != c.height {
+		log.Printf("Segment %s has different codec parameters, skipping\n", r.ID)
+		return false, nil
+	}
+
+	if aist != nil && (c.audio == nil || aist.GetCodecPar().GetCodecId() != c.audioCodecID) {
+		if c.audio != nil {
+			log.Printf("Segment %s has a different audio codec, copying without audio\n", r.ID)
+		}
+		aist = nil
+	}
+
+	st := &segmentState{tb: ist.TimeBase(), start: r.Start, track: c.video, first: video.NoPTS, base: video.NoPTS}
+
+	var ast *segmentState
+	if aist != nil {
+		ast = &segmentState{tb: aist.TimeBase(), start: r.Start, track: c.audio, first: video.NoPTS, base: video.NoPTS}
+	}
+
+	for {
+		pkt, err := ictx.GetNextPacket()
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, errors.Wrap(err, "error reading packet")
+		}
+
+		ts := pkt.Dts()
+		if ts == video.NoPTS {
+			ts = pkt.Pts()
+		}
+
+		if ast != nil && pkt.StreamIndex() == aist.Index() {
+			if ast.first == video.NoPTS {
+				// audio shares the segment's timeline with video
+				ast.first = ts
+				if st.first != video.NoPTS {
+					ast.first = gmf.RescaleQ(st.first, st.tb, ast.tb)
+				}
+			}
+
+			if err := c.copyAudio(pkt, ast.wall(ts), ast); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		if pkt.StreamIndex() != ist.Index() {
+			pkt.Free()
+			continue
+		}
+
+		if st.first == video.NoPTS {
+			st.first = ts
+		}
+
+		wall := st.wall(ts)
+		keyframe := pkt.Flags()&video.PktFlagKey != 0
+
+		if keyframe && !wall.Before(c.to) {
+			pkt.Free()
+			return true, nil
+		}
+
+		if !c.started {
+			if wall.Before(c.from) {
+				c.buffer(pkt, wall, st, keyframe)
+				continue
+			}
+
+			if len(c.pending) == 0 && !keyframe {
+				// footage begins mid-GOP, wait for a keyframe
+				pkt.Free()
+				continue
+			}
+
+			c.started = true
+			c.start = wall
+			if len(c.pending) > 0 {
+				c.start = c.pending[0].wall
+			}
+
+			for i, b := range c.pending {
+				if b.st.track == c.audio && b.wall.Before(c.start) {
+					// audio interleaved ahead of the first keyframe
+					b.pkt.Free()
+					continue
+				}
+
+				if err := c.write(b.pkt, b.st); err != nil {
+					c.pending = c.pending[i+1:]
+					return false, err
+				}
+			}
+			c.pending = nil
+		}
+
+		if err := c.write(pkt, st); err != nil {
+			return false, err
+		}
+	}
+}
+
+// copyAudio writes an audio packet once the clip has started. Audio ahead
+// of the start is buffered along with the video GOP it belongs to. The
+// packet is freed.
+func (c *clipWriter) copyAudio(pkt *gmf.Packet, wall time.Time, st *segmentState) error {
+	if !c.started {
+		c.buffer(pkt, wall, st, false)
+		return nil
+	}
+
+	if wall.Before(c.start) {
+		pkt.Free()
+		return nil
+	}
+
+	return c.write(pkt, st)
+}
+
+// buffer keeps the GOP preceding the start of the clip, along with its
+// audio, starting over at every keyframe
+func (c *clipWriter) buffer(pkt *gmf.Packet, wall time.Time, st *segmentState, keyframe bool) {
+	if keyframe {
+		c.releasePending()
+	} else if len(c.pending) == 0 {
+		pkt.Free()
+		return
+	}
+
+	c.pending = append(c.pending, bufferedPacket{pkt: pkt, wall: wall, st: st})
+}
+
+// write remaps the timestamps of a packet onto the clip and muxes it. The
+// packet is freed.
+func (c *clipWriter) write(pkt *gmf.Packet, st *segmentState) error {
+	defer pkt.Free()
+
+	track := st.track
+	istTb := st.tb
+	ostTb := track.ost.TimeBase()
+
+	dts := pkt.Dts()
+	if dts == video.NoPTS {
+		dts = pkt.Pts()
+	}
+
+	if st.base == video.NoPTS {
+		// place the segment by its wall-clock start, but never before
+		// what has already been written
+		st.base = gmf.RescaleQ(int64(st.start.Sub(c.start)/time.Microsecond), gmf.AV_TIME_BASE_Q, ostTb)
+		if track.lastDts != video.NoPTS {
+			if next := st.base + gmf.RescaleQ(dts-st.first, istTb, ostTb); next <= track.lastDts {
+				st.base += track.lastDts + 1 - next
+			}
+		}
+	}
+
+	outDts := st.base + gmf.RescaleQ(dts-st.first, istTb, ostTb)
+	outPts := outDts
+	if pkt.Pts() != video.NoPTS {
+		outPts = st.base + gmf.RescaleQ(pkt.Pts()-st.first, istTb, ostTb)
+	}
+
+	pkt.SetDts(outDts)
+	pkt.SetPts(outPts)
+	pkt.SetDuration(gmf.RescaleQ(pkt.Duration(), istTb, ostTb))
+	pkt.SetStreamIndex(track.ost.Index())
+
+	if err := c.ctx.WritePacket(pkt); err != nil {
+		return errors.Wrap(err, "error writing packet")
+	}
+	track.lastDts = outDts
+
+	return nil
+}
+
+// finish finalizes the clip
+func (c *clipWriter) finish() error {
+	if c.ctx == nil {
+		return ErrNoFootage
+	}
+
+	c.ctx.WriteTrailer()
+	c.ctx.Free()
+	c.ctx = nil
+
+	return nil
+}
+
+func (c *clipWriter) releasePending() {
+	for _, b := range c.pending {
+		b.pkt.Free()
+	}
+	c.pending = nil
+}
+
+// release frees anything left over after an error
+func (c *clipWriter) release() {
+	c.releasePending()
+
+	if c.ctx != nil {
+		c.ctx.Free()
+		c.ctx = nil
+	}
+}
@@ -0,0 +1,302 @@
+package archive
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/thenrich/go-surv/cloud"
+	"github.com/thenrich/go-surv/config"
+	"github.com/thenrich/go-surv/video"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RemoteStore defines the interface for archives kept with a cloud provider
+type RemoteStore interface {
+	List(prefix string) ([]*cloud.Object, error)
+	Delete(key string) error
+	Transition(key string, storageClass string) error
+}
+
+// Retention periodically prunes archived segments for every camera
+// according to its retention policy.
+type Retention struct {
+	cfg *config.Config
+
+	// cameras from the configuration and those added at runtime, which
+	// are kept after removal as their segments remain
+	mu      sync.Mutex
+	cameras []config.CameraConfig
+
+	// optional cloud archive
+	remote RemoteStore
+
+	// optional catalog kept in sync with deletions
+	catalog *Catalog
+}
+
+// SetRemote enables pruning of segments archived with a cloud provider
+func (r *Retention) SetRemote(remote RemoteStore) {
+	r.remote = remote
+}
+
+// SetCatalog sets the catalog deletions are recorded in
+func (r *Retention) SetCatalog(catalog *Catalog) {
+	r.catalog = catalog
+}
+
+// Start applies the retention policies every interval. It blocks forever.
+func (r *Retention) Start() {
+	ticker := time.NewTicker(r.cfg.Retention.Interval)
+	defer ticker.Stop()
+
+	for {
+		r.Run()
+		<-ticker.C
+	}
+}
+
+// AddCamera applies retention to a camera added at runtime, replacing any
+// earlier camera of the same name
+func (r *Retention) AddCamera(cam config.CameraConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.cameras {
+		if r.cameras[i].Name == cam.Name {
+			r.cameras[i] = cam
+			return
+		}
+	}
+
+	r.cameras = append(r.cameras, cam)
+}
+
+// Run applies the retention policy of every camera once
+func (r *Retention) Run() {
+	r.mu.Lock()
+	cameras := append([]config.CameraConfig(nil), r.cameras...)
+	r.mu.Unlock()
+
+	for _, cam := range cameras {
+		policy := r.cfg.Retention.Merge(cam.Retention)
+		if !policy.Enabled() {
+			continue
+		}
+
+		if err := r.pruneLocal(cam.Name, policy); err != nil {
+			log.Println(errors.Wrapf(err, "retention: error pruning local segments for %s", cam.Name))
+		}
+
+		if r.remote == nil {
+			continue
+		}
+
+		if err := r.pruneRemote(cam.Name, policy); err != nil {
+			log.Println(errors.Wrapf(err, "retention: error pruning remote segments for %s", cam.Name))
+		}
+	}
+}
+
+// pruneLocal deletes the oldest local segments of a camera until the policy
+// is satisfied. The newest segment is never touched as it may still be
+// recording.
+func (r *Retention) pruneLocal(name string, policy config.RetentionConfig) error {
+	dir := video.SegmentDir(r.cfg.StoragePath, name)
+	segments, err := video.ListSegments(dir, name)
+	if err != nil {
+		return err
+	}
+
+	if len(segments) < 2 {
+		return nil
+	}
+
+	var total int64
+	for _, seg := range segments {
+		total += seg.Size
+	}
+
+	var free int64
+	if policy.MinFreeBytes > 0 {
+		if free, err = freeBytes(dir); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	for _, seg := range segments[:len(segments)-1] {
+		reason := reasonFor(policy, now.Sub(seg.Start), total, free, true)
+		if reason == "" {
+			break
+		}
+
+		if r.pendingUpload(seg) {
+			continue
+		}
+
+		if !policy.DryRun {
+			if err := os.Remove(seg.Path); err != nil {
+				log.Println(errors.Wrapf(err, "retention: error removing %s", seg.Path))
+				continue
+			}
+		}
+
+		r.record(policy, "deleted", seg.Path, seg.Size, reason)
+		if r.catalog != nil && !policy.DryRun {
+			if err := r.catalog.RemovedLocal(seg.ID()); err != nil {
+				log.Println(errors.Wrap(err, "retention: error updating catalog"))
+			}
+		}
+		total -= seg.Size
+		free += seg.Size
+	}
+
+	return nil
+}
+
+// pendingUpload returns true for local segments that are staged for upload
+// to S3 and haven't been uploaded yet. They are left to the uploader, which
+// removes them once archived.
+func (r *Retention) pendingUpload(seg *video.Segment) bool {
+	if r.cfg.Storage != config.StorageS3 {
+		return false
+	}
+
+	if r.catalog == nil {
+		return true
+	}
+
+	rec := r.catalog.Get(seg.ID())
+	return rec == nil || !rec.Remote()
+}
+
+// pruneRemote deletes the oldest archived objects of a camera until the
+// policy is satisfied and moves the remaining old objects to the configured
+// storage class.
+func (r *Retention) pruneRemote(name string, policy config.RetentionConfig) error {
+	objects, err := r.remote.List(name + "/")
+	if err != nil {
+		return err
+	}
+
+	starts := make(map[*cloud.Object]time.Time, len(objects))
+	var total int64
+	for _, o := range objects {
+		start, err := video.ParseSegmentTime(name, path.Base(o.Key))
+		if err != nil {
+			start = o.LastModified
+		}
+		starts[o] = start
+		total += o.Size
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return starts[objects[i]].Before(starts[objects[j]])
+	})
+
+	now := time.Now().UTC()
+	var remaining []*cloud.Object
+	for i, o := range objects {
+		reason := reasonFor(policy, now.Sub(starts[o]), total, 0, false)
+		if reason == "" {
+			remaining = append(remaining, objects[i:]...)
+			break
+		}
+
+		if !policy.DryRun {
+			if err := r.remote.Delete(o.Key); err != nil {
+				log.Println(errors.Wrap(err, "retention"))
+				continue
+			}
+		}
+
+		r.record(policy, "deleted", o.Key, o.Size, reason)
+		if r.catalog != nil && !policy.DryRun {
+			if err := r.catalog.RemovedRemote(video.SegmentID(o.Key)); err != nil {
+				log.Println(errors.Wrap(err, "retention: error updating catalog"))
+			}
+		}
+		total -= o.Size
+	}
+
+	if policy.TransitionAge == 0 || policy.TransitionStorageClass == "" {
+		return nil
+	}
+
+	for _, o := range remaining {
+		if now.Sub(starts[o]) < policy.TransitionAge || o.StorageClass == policy.TransitionStorageClass {
+			continue
+		}
+
+		if !policy.DryRun {
+			if err := r.remote.Transition(o.Key, policy.TransitionStorageClass); err != nil {
+				log.Println(errors.Wrap(err, "retention"))
+				continue
+			}
+		}
+
+		r.record(policy, "transitioned to "+policy.TransitionStorageClass, o.Key, o.Size, "transition age")
+	}
+
+	return nil
+}
+
+// reasonFor returns why a segment of the given age should be removed, or
+// an empty string if the policy is satisfied. Minimum free space is only
+// checked for local segments.
+func reasonFor(policy config.RetentionConfig, age time.Duration, total int64, free int64, local bool) string {
+	switch {
+	case policy.MaxAge > 0 && age > policy.MaxAge:
+		return "max age"
+	case policy.MaxBytes > 0 && total > int64(policy.MaxBytes):
+		return "max bytes"
+	case local && policy.MinFreeBytes > 0 && free < int64(policy.MinFreeBytes):
+		return "min free disk"
+	}
+
+	return ""
+}
+
+// record logs a retention action and appends it to the policy's log file
+func (r *Retention) record(policy config.RetentionConfig, action string, target string, size int64, reason string) {
+	prefix := "retention:"
+	if policy.DryRun {
+		prefix = "retention (dry run): would have"
+	}
+	msg := fmt.Sprintf("%s %s %s (%d bytes, %s)", prefix, action, target, size, reason)
+	log.Println(msg)
+
+	if policy.LogFile == "" {
+		return
+	}
+
+	f, err := os.OpenFile(policy.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println(errors.Wrapf(err, "retention: error opening %s", policy.LogFile))
+		return
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "%s %s\n", time.Now().UTC().Format(time.RFC3339), msg)
+}
+
+// freeBytes returns the space available to unprivileged users on the
+// volume holding dir
+func freeBytes(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, errors.Wrapf(err, "error reading free space for %s", dir)
+	}
+
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// NewRetention creates a retention engine for the cameras in cfg
+func NewRetention(cfg *config.Config) *Retention {
+	return &Retention{cfg: cfg, cameras: append([]config.CameraConfig(nil), cfg.Cameras...)}
+}
@@ -0,0 +1,182 @@
+package archive
+
+import (
+	"github.com/3d0c/gmf"
+	"github.com/pkg/errors"
+	"github.com/thenrich/go-surv/config"
+	"github.com/thenrich/go-surv/video"
+	"io"
+	"log"
+	"time"
+)
+
+// Timelapse encodes a timelapse to dst from the footage of a camera between
+// from and to, sampling one frame every interval. Segments that can't be
+// read are skipped.
+func (e *Exporter) Timelapse(camera string, from time.Time, to time.Time, interval time.Duration, frameRate int, dst string) error {
+	if !from.Before(to) {
+		return errors.New("start of timelapse must be before its end")
+	}
+
+	records := e.catalog.Find(camera, from, to)
+	if len(records) == 0 {
+		return ErrNoFootage
+	}
+
+	enc := video.NewTimelapseEncoder(dst, frameRate)
+
+	next := from
+	for _, r := range records {
+		path, cleanup, err := e.fetch(r)
+		if err != nil {
+			log.Println(errors.Wrap(err, "timelapse: skipping segment"))
+			continue
+		}
+
+		next, err = sampleSegment(enc, r, path, next, to, interval)
+		cleanup()
+		if err != nil {
+			log.Println(errors.Wrapf(err, "timelapse: error sampling segment %s", r.ID))
+		}
+
+		if !next.Before(to) {
+			break
+		}
+	}
+
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	if enc.Frames() == 0 {
+		return ErrNoFootage
+	}
+
+	return nil
+}
+
+// sampleSegment decodes a segment and writes the first frame at or after
+// next, and every interval after that, to enc. It returns the time of the
+// next frame to sample.
+func sampleSegment(enc *video.TimelapseEncoder, r *Record, path string, next time.Time, to time.Time, interval time.Duration) (time.Time, error) {
+	ictx, err := gmf.NewInputCtx(path)
+	if err != nil {
+		return next, errors.Wrapf(err, "error opening %s", path)
+	}
+	defer ictx.Free()
+
+	ist, err := ictx.GetBestStream(gmf.AVMEDIA_TYPE_VIDEO)
+	if err != nil {
+		return next, errors.Wrapf(err, "error finding stream in %s", path)
+	}
+
+	dec := ist.CodecCtx()
+	if dec == nil {
+		return next, errors.Errorf("no decoder for %s", path)
+	}
+	defer gmf.Release(dec)
+
+	st := &segmentState{tb: ist.TimeBase(), start: r.Start, first: video.NoPTS}
+	for {
+		pkt, err := ictx.GetNextPacket()
+		if err == io.EOF {
+			return next, nil
+		} else if err != nil {
+			return next, errors.Wrap(err, "error reading packet")
+		}
+
+		if pkt.StreamIndex() != ist.Index() {
+			pkt.Free()
+			continue
+		}
+
+		ts := pkt.Dts()
+		if ts == video.NoPTS {
+			ts = pkt.Pts()
+		}
+		if st.first == video.NoPTS {
+			st.first = ts
+		}
+
+		if !st.wall(ts).Before(to) {
+			pkt.Free()
+			return next, nil
+		}
+
+		// every packet is decoded as later frames reference earlier ones
+		frames, err := dec.Decode(pkt)
+		pkt.Free()
+		if err != nil {
+			log.Println(errors.Wrap(err, "timelapse: error decoding packet"))
+			continue
+		}
+
+		for _, f := range frames {
+			at := st.wall(ts)
+			if f.Pts() != video.NoPTS {
+				at = st.wall(f.Pts())
+			}
+
+			if err == nil && !at.Before(next) && at.Before(to) {
+				if err = enc.WriteFrame(f, dec); err == nil {
+					for !next.After(at) {
+						next = next.Add(interval)
+					}
+				}
+			}
+			f.Free()
+		}
+
+		if err != nil {
+			return next, err
+		}
+	}
+}
+
+// Timelapses builds the previous day's timelapse from recorded segments
+// for every camera configured to sample the archive.
+type Timelapses struct {
+	cfg      *config.Config
+	exporter *Exporter
+}
+
+// Start builds timelapses once a day after midnight. It blocks forever.
+func (t *Timelapses) Start() {
+	for {
+		now := time.Now()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+
+		// wait for the segments still recording at midnight to be finalized
+		time.Sleep(midnight.Add(t.cfg.StorageInterval + time.Minute).Sub(now))
+
+		t.Run(midnight.AddDate(0, 0, -1), midnight)
+	}
+}
+
+// Run builds a timelapse covering [from, to) for every camera sampling the
+// archive
+func (t *Timelapses) Run(from time.Time, to time.Time) {
+	for _, cam := range t.cfg.Cameras {
+		tl := t.cfg.TimelapseFor(cam)
+		if !tl.Enabled() || tl.Source != config.TimelapseArchive {
+			continue
+		}
+
+		dst := video.TimelapsePath(t.cfg.StoragePath, cam.Name, from.UTC())
+		err := t.exporter.Timelapse(cam.Name, from.UTC(), to.UTC(), tl.Interval, tl.FrameRate, dst)
+		if errors.Cause(err) == ErrNoFootage {
+			log.Printf("timelapse: no footage for %s between %s and %s\n", cam.Name, from, to)
+			continue
+		} else if err != nil {
+			log.Println(errors.Wrapf(err, "timelapse: error building timelapse for %s", cam.Name))
+			continue
+		}
+
+		log.Printf("timelapse: wrote %s\n", dst)
+	}
+}
+
+// NewTimelapses creates the daily timelapse job for the cameras in cfg
+func NewTimelapses(cfg *config.Config, exporter *Exporter) *Timelapses {
+	return &Timelapses{cfg: cfg, exporter: exporter}
+}
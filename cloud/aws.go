@@ -1,20 +1,42 @@
 package cloud
 
 import (
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/aws"
+	"time"
 )
 
 var S3Uploader *s3manager.Uploader
+var S3Downloader *s3manager.Downloader
+var S3Client *s3.S3
 var Config *aws.Config
 var sess *session.Session
 
+// Object describes a file stored with a cloud provider
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	StorageClass string
+}
+
 func ConfigureS3(cfg *aws.Config) {
 	sess = session.Must(session.NewSession(cfg))
 	S3Uploader = s3manager.NewUploader(sess)
+	S3Downloader = s3manager.NewDownloader(sess)
+	S3Client = s3.New(sess)
 }
 
 func Uploader() *s3manager.Uploader {
 	return S3Uploader
-}
\ No newline at end of file
+}
+
+func Downloader() *s3manager.Downloader {
+	return S3Downloader
+}
+
+func Client() *s3.S3 {
+	return S3Client
+}
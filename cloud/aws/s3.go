@@ -1,6 +1,7 @@
 package aws
 
 import (
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/aws"
 	"log"
@@ -11,8 +12,10 @@ import (
 )
 
 type S3Storage struct {
-	S3     *s3manager.Uploader
-	Bucket string
+	S3         *s3manager.Uploader
+	Downloader *s3manager.Downloader
+	Client     *s3.S3
+	Bucket     string
 }
 
 func (s3 *S3Storage) UploadFile(r io.ReadCloser, key string) error {
@@ -28,6 +31,72 @@ func (s3 *S3Storage) UploadFile(r io.ReadCloser, key string) error {
 	return nil
 }
 
+// DownloadFile downloads an object from the bucket into w
+func (st *S3Storage) DownloadFile(w io.WriterAt, key string) error {
+	_, err := st.Downloader.Download(w, &s3.GetObjectInput{
+		Bucket: aws.String(st.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error downloading %s", key)
+	}
+
+	return nil
+}
+
+// List returns every object in the bucket under prefix
+func (st *S3Storage) List(prefix string) ([]*cloud.Object, error) {
+	var objects []*cloud.Object
+	err := st.Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(st.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			objects = append(objects, &cloud.Object{
+				Key:          aws.StringValue(o.Key),
+				Size:         aws.Int64Value(o.Size),
+				LastModified: aws.TimeValue(o.LastModified),
+				StorageClass: aws.StringValue(o.StorageClass),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing %s", prefix)
+	}
+
+	return objects, nil
+}
+
+// Delete removes an object from the bucket
+func (st *S3Storage) Delete(key string) error {
+	_, err := st.Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(st.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error deleting %s", key)
+	}
+
+	return nil
+}
+
+// Transition moves an object to another storage class by copying it onto
+// itself
+func (st *S3Storage) Transition(key string, storageClass string) error {
+	_, err := st.Client.CopyObject(&s3.CopyObjectInput{
+		Bucket:       aws.String(st.Bucket),
+		Key:          aws.String(key),
+		CopySource:   aws.String(st.Bucket + "/" + key),
+		StorageClass: aws.String(storageClass),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error transitioning %s to %s", key, storageClass)
+	}
+
+	return nil
+}
+
 func NewS3Storage(cfg config.AWSConfig, bucket string) *S3Storage {
-	return &S3Storage{S3: cloud.Uploader(), Bucket: bucket}
+	return &S3Storage{S3: cloud.Uploader(), Downloader: cloud.Downloader(), Client: cloud.Client(), Bucket: bucket}
 }
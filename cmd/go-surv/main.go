@@ -4,7 +4,10 @@ import (
 	"flag"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/pkg/errors"
+	"github.com/thenrich/go-surv/archive"
 	"github.com/thenrich/go-surv/cloud"
+	gaws "github.com/thenrich/go-surv/cloud/aws"
 	"github.com/thenrich/go-surv/config"
 	ghttp "github.com/thenrich/go-surv/http"
 	"github.com/thenrich/go-surv/video"
@@ -12,10 +15,16 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
 	conf := flag.String("conf", "", "config file")
+	timelapse := flag.String("timelapse", "", "build a timelapse of this camera from recorded segments and exit")
+	from := flag.String("from", "", "start of the timelapse (RFC 3339)")
+	to := flag.String("to", "", "end of the timelapse (RFC 3339), defaults to now")
+	out := flag.String("out", "", "timelapse output file, defaults to the camera's timelapse directory")
 	flag.Parse()
 
 	if *conf == "" {
@@ -34,29 +43,218 @@ func main() {
 		cloud.ConfigureS3(awsCfg)
 	}
 
+	if cfg.Storage == config.StorageS3 && !cfg.AWS.Ready() {
+		log.Fatal("storage is s3 but the aws configuration is incomplete")
+	}
+
+	var s3storage *gaws.S3Storage
+	if cfg.AWS.Ready() && cfg.Storage == config.StorageS3 {
+		s3storage = gaws.NewS3Storage(cfg.AWS, cfg.AWS.S3Bucket)
+	}
+
+	catalog, err := archive.OpenCatalog(cfg.CatalogPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	exporter := archive.NewExporter(catalog)
+	if s3storage != nil {
+		exporter.SetRemote(s3storage)
+	}
+
+	if *timelapse != "" {
+		buildTimelapse(cfg, exporter, *timelapse, *from, *to, *out)
+		return
+	}
+
+	// catalog segments left behind when the process last stopped
+	if err := catalog.Scan(cfg.StoragePath); err != nil {
+		log.Fatal(err)
+	}
+
+	retention := archive.NewRetention(cfg)
+	retention.SetCatalog(catalog)
+	if s3storage != nil {
+		retention.SetRemote(s3storage)
+	}
+
 	ch := video.NewCameraHandler(cfg)
 	for _, cfgCam := range cfg.Cameras {
-		camera := video.NewCamera(cfgCam.Name, cfgCam.Source, cfg.StorageInterval)
-		if cfg.AWS.Ready() && cfg.Storage == "s3" {
-			//s3storage := gaws.NewS3Storage(cfg.AWS, cfg.AWS.S3Bucket)
-			//camera.AddWriter(video.NewCloudStorage(camera.Name, cfg.StorageInterval, cfg, s3storage))
+		camera, err := newCamera(cfg, cfgCam, catalog, s3storage)
+		if err != nil {
+			log.Fatal(err)
 		}
 		ch.AddCamera(camera)
 	}
 
+	ch.SetFactory(func(cfgCam config.CameraConfig) (*video.Camera, error) {
+		return newCamera(cfg, cfgCam, catalog, s3storage)
+	})
+
+	// cameras added at runtime are pruned like the configured ones
+	ch.OnAdd(retention.AddCamera)
+
+	go retention.Start()
+
+	go archive.NewTimelapses(cfg, exporter).Start()
+
 	log.Println("Start streams")
 	go ch.StartStreams()
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for sig := range c {
-			if sig == os.Interrupt {
-				ch.CloseStreams()
-				log.Fatal("Terminating...")
-			}
+		for range c {
+			// finalizes the segments being recorded
+			ch.CloseStreams()
+			log.Fatal("Terminating...")
 		}
 	}()
 
-	http.ListenAndServe(":8080", ghttp.NewHandler(ch))
+	http.ListenAndServe(":8080", ghttp.NewHandler(ch, exporter, cfg.Admin.Token))
+}
+
+// newCamera creates a camera and its writers from its configuration
+func newCamera(cfg *config.Config, cfgCam config.CameraConfig, catalog *archive.Catalog, s3storage *gaws.S3Storage) (*video.Camera, error) {
+	camera := video.NewCamera(cfgCam.Name, cfgCam.Source, cfg.StorageInterval)
+	camera.PreRoll = cfg.PreRollFor(cfgCam)
+	camera.ReadTimeout = cfg.ReadTimeoutFor(cfgCam)
+	camera.StallTimeout = cfg.StallTimeoutFor(cfgCam)
+	camera.Audio = cfgCam.Audio
+	camera.SubSourceURL = cfgCam.SubSource
+	camera.InputOptions = cfgCam.InputOptions()
+	camera.LowDelay = cfgCam.LowLatency
+
+	still := cfg.StillFor(cfgCam)
+	camera.Still = video.StillOptions{
+		Format:    still.Format,
+		Quality:   still.Quality,
+		MaxWidth:  still.MaxWidth,
+		MaxHeight: still.MaxHeight,
+	}
+
+	if cfgCam.Overlay != nil {
+		loc, err := cfgCam.Overlay.Location()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid overlay for %s", cfgCam.Name)
+		}
+
+		camera.Overlay = &video.OverlayOptions{
+			Position: video.OverlayPosition(cfgCam.Overlay.Position),
+			FontSize: cfgCam.Overlay.FontSize,
+			FontFile: cfgCam.Overlay.FontFile,
+			Format:   cfgCam.Overlay.Format,
+			Location: loc,
+		}
+		camera.OverlayRecordings = cfgCam.Overlay.Recordings
+	}
+
+	masks := make([]video.Mask, len(cfgCam.Masks))
+	for i, m := range cfgCam.Masks {
+		masks[i] = video.Mask(m)
+	}
+	if err := camera.Masks.Set(masks); err != nil {
+		return nil, errors.Wrapf(err, "invalid masks for %s", cfgCam.Name)
+	}
+
+	if cfg.SnapshotHistory > 0 {
+		camera.Snapshots = video.NewSnapshotStore(cfg.SnapshotHistory)
+	}
+
+	if cfgCam.Decode != "" {
+		camera.Decode = cfgCam.Decode
+	}
+	camera.DecodeInterval = cfgCam.DecodeInterval
+
+	queue := cfg.QueueFor(cfgCam)
+	camera.QueueSize = queue.Size
+	camera.DropPolicy = queue.Policy
+
+	var recorder video.PacketWriter
+	if s3storage != nil {
+		cs := video.NewCloudStorage(camera.Name, cfg.StoragePath, cfg.StorageInterval, s3storage)
+		cs.SetFragmented(cfg.SegmentFormat == config.SegmentFormatFMP4)
+		cs.SetCatalog(catalog)
+		recorder = cs
+	}
+	if cfg.Storage == config.StorageLocal {
+		lw := video.NewLocalWriter(camera.Name, cfg.StoragePath, cfg.StorageInterval)
+		lw.SetFragmented(cfg.SegmentFormat == config.SegmentFormatFMP4)
+		lw.SetCatalog(catalog)
+		recorder = lw
+	}
+
+	if recorder != nil && cfg.RecordFor(cfgCam) == config.RecordMotion {
+		motion := cfg.MotionFor(cfgCam)
+		detector := video.NewMotionDetector(motion.Threshold, motion.MinArea)
+		camera.AddWriter(detector)
+		recorder = video.NewMotionWriter(recorder, detector, motion.PostRoll)
+	}
+
+	if recorder != nil && cfgCam.Schedule != nil {
+		schedule, err := cfgCam.Schedule.Parse()
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing schedule for %s", cfgCam.Name)
+		}
+		recorder = video.NewScheduledWriter(camera.Name, recorder, schedule)
+	}
+
+	if recorder != nil && cfgCam.MaskRecordings {
+		// the main stream is decoded and re-encoded with the masks applied
+		camera.AddRecordingWriter(video.NewEncodingWriter(camera.Name, recorder, camera.PreRoll))
+	} else if recorder != nil {
+		camera.AddPacketWriter(recorder)
+	}
+
+	if tl := cfg.TimelapseFor(cfgCam); tl.Enabled() && tl.Source == config.TimelapseLive {
+		tw := video.NewTimelapseWriter(camera.Name, cfg.StoragePath, tl.Interval, tl.FrameRate)
+		if cfgCam.Overlay != nil && cfgCam.Overlay.Recordings {
+			camera.AddOverlaidWriter(tw)
+		} else {
+			camera.AddWriter(tw)
+		}
+	}
+
+	return camera, nil
+}
+
+// buildTimelapse builds a timelapse of a camera from recorded segments using
+// the camera's timelapse settings
+func buildTimelapse(cfg *config.Config, exporter *archive.Exporter, name string, from string, to string, out string) {
+	var cam *config.CameraConfig
+	for i := range cfg.Cameras {
+		if cfg.Cameras[i].Name == name {
+			cam = &cfg.Cameras[i]
+		}
+	}
+	if cam == nil {
+		log.Fatalf("unknown camera %s", name)
+	}
+
+	start, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "invalid -from"))
+	}
+
+	end := time.Now()
+	if to != "" {
+		if end, err = time.Parse(time.RFC3339, to); err != nil {
+			log.Fatal(errors.Wrap(err, "invalid -to"))
+		}
+	}
+
+	if out == "" {
+		out = video.TimelapsePath(cfg.StoragePath, name, start.UTC())
+	}
+
+	tl := cfg.TimelapseFor(*cam)
+	if tl.Interval == 0 {
+		tl.Interval = config.DefaultTimelapseInterval
+	}
+
+	if err := exporter.Timelapse(name, start.UTC(), end.UTC(), tl.Interval, tl.FrameRate, out); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Wrote %s\n", out)
 }
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Source URL schemes cameras added at runtime may use
+var remoteSchemes = map[string]bool{
+	"rtsp":  true,
+	"rtsps": true,
+	"rtmp":  true,
+	"http":  true,
+	"https": true,
+}
+
+// Input options cameras added at runtime may not set, they decide which
+// protocols FFmpeg opens
+var restrictedOptions = map[string]bool{
+	"protocol_whitelist": true,
+	"protocol_blacklist": true,
+}
+
+// AdminConfig enables the admin endpoints changing cameras at runtime
+type AdminConfig struct {
+	// Bearer token required by the admin endpoints. They are disabled
+	// without one.
+	Token string `yaml:"token"`
+}
+
+// ValidateRemote checks that a camera added at runtime only reads from the
+// network and doesn't name local files, so callers can't make FFmpeg open
+// local files or other inputs, or have files written
+func (c CameraConfig) ValidateRemote() error {
+	for _, source := range []string{c.Source, c.SubSource} {
+		if source == "" {
+			continue
+		}
+
+		u, err := url.Parse(source)
+		if err != nil {
+			return errors.Wrapf(err, "invalid source for %s", c.Name)
+		}
+
+		if !remoteSchemes[strings.ToLower(u.Scheme)] {
+			return errors.Errorf("unsupported source scheme %q for %s", u.Scheme, c.Name)
+		}
+	}
+
+	for k := range c.Options {
+		if restrictedOptions[k] {
+			return errors.Errorf("option %s can't be set for %s", k, c.Name)
+		}
+	}
+
+	if c.Retention != nil && c.Retention.LogFile != "" {
+		return errors.Errorf("retention.logFile can't be set for %s", c.Name)
+	}
+
+	if c.Overlay != nil && c.Overlay.FontFile != "" {
+		return errors.Errorf("overlay.fontFile can't be set for %s", c.Name)
+	}
+
+	return nil
+}
@@ -1,29 +1,597 @@
 package config
 
 import (
+	"strconv"
+	"strings"
 	"time"
 	"io/ioutil"
+	"path/filepath"
 	"gopkg.in/yaml.v2"
 	"github.com/pkg/errors"
 )
 
 type Config struct {
-	// Storage medium for recorded video
+	// Storage medium for recorded video, local or s3. Nothing is recorded
+	// without one.
 	Storage string `yaml:"storage"`
 
 	// Length of recorded segments for storage
 	StorageInterval time.Duration `yaml:"storageInterval"`
 
+	// Directory where recorded segments are written
+	StoragePath string `yaml:"storagePath"`
+
+	// File the recording catalog is kept in, defaults to catalog.jsonl in
+	// the storage path
+	CatalogPath string `yaml:"catalogPath"`
+
+	// Container for recorded segments, fmp4 or mp4
+	SegmentFormat string `yaml:"segmentFormat"`
+
 	// AWS configuration
 	AWS AWSConfig `yaml:"aws"`
 
+	// Recording mode, continuous or motion
+	Record string `yaml:"record"`
+
+	// Motion detection settings for motion recording
+	Motion MotionConfig `yaml:"motion"`
+
+	// Footage kept in memory ahead of event-based recordings, rounded up to
+	// the start of a GOP
+	PreRoll time.Duration `yaml:"preRoll"`
+
+	// Retention policy applied to every camera
+	Retention RetentionConfig `yaml:"retention"`
+
+	// Timelapse settings applied to every camera
+	Timelapse TimelapseConfig `yaml:"timelapse"`
+
+	// Socket timeout when connecting to and reading from RTSP cameras
+	ReadTimeout time.Duration `yaml:"readTimeout"`
+
+	// Restart a stream when no packet has arrived for this long
+	StallTimeout time.Duration `yaml:"stallTimeout"`
+
+	// Queues between each camera and its writers
+	Queue QueueConfig `yaml:"queue"`
+
+	// Number of recent stills kept per camera
+	SnapshotHistory int `yaml:"snapshotHistory"`
+
+	// Format, quality and size of stills
+	Still StillConfig `yaml:"still"`
+
+	// Admin endpoints, disabled by default
+	Admin AdminConfig `yaml:"admin"`
+
 	// Camera configuration
-	Cameras []struct {
-		Name   string `yaml:"name"`
-		Source string `yaml:"source"`
-	} `yaml:"cameras"`
+	Cameras []CameraConfig `yaml:"cameras"`
+}
+
+// CameraConfig defines a single camera
+type CameraConfig struct {
+	Name   string `yaml:"name"`
+	Source string `yaml:"source"`
+
+	// Optional low resolution substream, decoded for stills, motion
+	// detection and live timelapses instead of the main source
+	SubSource string `yaml:"subSource"`
+
+	// Overrides the global recording mode
+	Record string `yaml:"record"`
+
+	// Overrides for the global motion detection settings
+	Motion *MotionConfig `yaml:"motion"`
+
+	// Overrides the global pre-roll
+	PreRoll time.Duration `yaml:"preRoll"`
+
+	// Overrides for the global retention policy
+	Retention *RetentionConfig `yaml:"retention"`
+
+	// Overrides for the global timelapse settings
+	Timelapse *TimelapseConfig `yaml:"timelapse"`
+
+	// Optional weekly windows the camera records in, always recording
+	// when unset
+	Schedule *ScheduleConfig `yaml:"schedule"`
+
+	// Override the global timeouts
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	StallTimeout time.Duration `yaml:"stallTimeout"`
+
+	// Decode all (default) frames or only keyframes, at most once per
+	// decodeInterval, for stills, motion detection and live timelapses
+	Decode         DecodeMode    `yaml:"decode"`
+	DecodeInterval time.Duration `yaml:"decodeInterval"`
+
+	// Overrides for the global still settings
+	Still *StillConfig `yaml:"still"`
+
+	// Overrides for the global writer queue settings
+	Queue *QueueConfig `yaml:"queue"`
+
+	// Camera name and time drawn on stills, none if unset
+	Overlay *OverlayConfig `yaml:"overlay"`
+
+	// Privacy masks blanked out of stills and frame writers. With
+	// maskRecordings the main stream is re-encoded with the masks applied
+	// instead of being remuxed.
+	Masks          []MaskConfig `yaml:"masks"`
+	MaskRecordings bool         `yaml:"maskRecordings"`
+
+	// Record the camera's audio track. Codecs MP4 can't hold, e.g. G.711,
+	// are transcoded to AAC.
+	Audio bool `yaml:"audio"`
+
+	// RTSP transport preset: tcp, udp, udp_multicast, http or https
+	Transport string `yaml:"transport"`
+
+	// Preset disabling input buffering and decoding with the low delay
+	// flag to reduce latency
+	LowLatency bool `yaml:"lowLatency"`
+
+	// FFmpeg options used when opening the sources, e.g. buffer_size or
+	// probesize. Overrides the presets.
+	Options map[string]string `yaml:"options"`
+}
+
+// MotionConfig tunes motion detection. Zero values use the defaults.
+type MotionConfig struct {
+	// Minimum change in a pixel's brightness (0-255) for it to count as
+	// changed
+	Threshold int `yaml:"threshold"`
+
+	// Fraction of changed pixels (0-1) that counts as motion
+	MinArea float64 `yaml:"minArea"`
+
+	// Keep recording this long after motion stops
+	PostRoll time.Duration `yaml:"postRoll"`
+}
+
+// Merge returns a copy of m with the non-zero settings of o applied on top
+func (m MotionConfig) Merge(o *MotionConfig) MotionConfig {
+	if o == nil {
+		return m
+	}
+
+	if o.Threshold > 0 {
+		m.Threshold = o.Threshold
+	}
+	if o.MinArea > 0 {
+		m.MinArea = o.MinArea
+	}
+	if o.PostRoll > 0 {
+		m.PostRoll = o.PostRoll
+	}
+
+	return m
+}
+
+// RetentionConfig bounds the growth of archived segments. Zero values
+// disable the corresponding limit.
+type RetentionConfig struct {
+	// How often the retention policy is applied. Only read from the global
+	// policy.
+	Interval time.Duration `yaml:"interval"`
+
+	// Delete segments older than this
+	MaxAge time.Duration `yaml:"maxAge"`
+
+	// Delete the oldest segments once a camera's archive exceeds this size
+	MaxBytes ByteSize `yaml:"maxBytes"`
+
+	// Delete the oldest local segments while free space on the storage
+	// volume is below this size
+	MinFreeBytes ByteSize `yaml:"minFreeBytes"`
+
+	// Move S3 objects older than TransitionAge to TransitionStorageClass,
+	// e.g. STANDARD_IA or GLACIER
+	TransitionAge          time.Duration `yaml:"transitionAge"`
+	TransitionStorageClass string        `yaml:"transitionStorageClass"`
+
+	// Log what would be deleted without deleting anything
+	DryRun bool `yaml:"dryRun"`
+
+	// Optional file deletions are appended to
+	LogFile string `yaml:"logFile"`
+}
+
+// Enabled returns true if any retention limit is configured
+func (r RetentionConfig) Enabled() bool {
+	return r.MaxAge > 0 || r.MaxBytes > 0 || r.MinFreeBytes > 0 ||
+		(r.TransitionAge > 0 && r.TransitionStorageClass != "")
+}
+
+// Merge returns a copy of r with the non-zero limits of o applied on top
+func (r RetentionConfig) Merge(o *RetentionConfig) RetentionConfig {
+	if o == nil {
+		return r
+	}
+
+	if o.MaxAge > 0 {
+		r.MaxAge = o.MaxAge
+	}
+	if o.MaxBytes > 0 {
+		r.MaxBytes = o.MaxBytes
+	}
+	if o.MinFreeBytes > 0 {
+		r.MinFreeBytes = o.MinFreeBytes
+	}
+	if o.TransitionAge > 0 {
+		r.TransitionAge = o.TransitionAge
+	}
+	if o.TransitionStorageClass != "" {
+		r.TransitionStorageClass = o.TransitionStorageClass
+	}
+	if o.DryRun {
+		r.DryRun = true
+	}
+	if o.LogFile != "" {
+		r.LogFile = o.LogFile
+	}
+
+	return r
+}
+
+// TimelapseConfig configures daily timelapses. Timelapses are disabled
+// while no interval is set.
+type TimelapseConfig struct {
+	// Time between sampled frames
+	Interval time.Duration `yaml:"interval"`
+
+	// Playback frame rate of the timelapse
+	FrameRate int `yaml:"frameRate"`
+
+	// Where frames are sampled from, live or archive
+	Source string `yaml:"source"`
+}
+
+// Enabled returns true if timelapses are configured
+func (t TimelapseConfig) Enabled() bool {
+	return t.Interval > 0
+}
+
+// Merge returns a copy of t with the non-zero settings of o applied on top
+func (t TimelapseConfig) Merge(o *TimelapseConfig) TimelapseConfig {
+	if o == nil {
+		return t
+	}
+
+	if o.Interval > 0 {
+		t.Interval = o.Interval
+	}
+	if o.FrameRate > 0 {
+		t.FrameRate = o.FrameRate
+	}
+	if o.Source != "" {
+		t.Source = o.Source
+	}
+
+	return t
+}
+
+// QueueConfig sizes the queue each writer is fed from and decides what
+// happens when a slow writer lets it fill up
+type QueueConfig struct {
+	// Maximum number of packets or frames queued per writer
+	Size int `yaml:"size"`
+
+	// dropOldest, dropNonKeyframes or block
+	Policy DropPolicy `yaml:"policy"`
+}
+
+// Merge returns a copy of q with the non-zero settings of o applied on top
+func (q QueueConfig) Merge(o *QueueConfig) QueueConfig {
+	if o == nil {
+		return q
+	}
+
+	if o.Size > 0 {
+		q.Size = o.Size
+	}
+	if o.Policy != "" {
+		q.Policy = o.Policy
+	}
+
+	return q
+}
+
+// StillConfig configures still images. Zero values use the defaults.
+type StillConfig struct {
+	// jpeg, png or webp
+	Format StillFormat `yaml:"format"`
+
+	// 1-100, ignored for png
+	Quality int `yaml:"quality"`
+
+	// Stills are scaled down to fit
+	MaxWidth  int `yaml:"maxWidth"`
+	MaxHeight int `yaml:"maxHeight"`
+}
+
+// Merge returns a copy of s with the non-zero settings of o applied on top
+func (s StillConfig) Merge(o *StillConfig) StillConfig {
+	if o == nil {
+		return s
+	}
+
+	if o.Format != "" {
+		s.Format = o.Format
+	}
+	if o.Quality > 0 {
+		s.Quality = o.Quality
+	}
+	if o.MaxWidth > 0 {
+		s.MaxWidth = o.MaxWidth
+	}
+	if o.MaxHeight > 0 {
+		s.MaxHeight = o.MaxHeight
+	}
+
+	return s
+}
+
+// RecordFor returns the effective recording mode for a camera
+func (c *Config) RecordFor(cam CameraConfig) string {
+	if cam.Record != "" {
+		return cam.Record
+	}
+
+	if c.Record != "" {
+		return c.Record
+	}
+
+	return RecordContinuous
+}
+
+// MotionFor returns the effective motion detection settings for a camera
+func (c *Config) MotionFor(cam CameraConfig) MotionConfig {
+	m := c.Motion.Merge(cam.Motion)
+
+	if m.Threshold == 0 {
+		m.Threshold = DefaultMotionThreshold
+	}
+	if m.MinArea == 0 {
+		m.MinArea = DefaultMotionMinArea
+	}
+	if m.PostRoll == 0 {
+		m.PostRoll = DefaultPostRoll
+	}
+
+	return m
+}
+
+// PreRollFor returns the effective pre-roll for a camera. Cameras recording
+// on motion always keep some pre-roll.
+func (c *Config) PreRollFor(cam CameraConfig) time.Duration {
+	if cam.PreRoll > 0 {
+		return cam.PreRoll
+	}
+
+	if c.PreRoll == 0 && c.RecordFor(cam) == RecordMotion {
+		return DefaultPreRoll
+	}
+
+	return c.PreRoll
 }
 
+// StillFor returns the effective still settings for a camera
+func (c *Config) StillFor(cam CameraConfig) StillConfig {
+	s := c.Still.Merge(cam.Still)
+
+	if s.Format == "" {
+		s.Format = StillJPEG
+	}
+	if s.Quality == 0 {
+		s.Quality = DefaultStillQuality
+	}
+
+	return s
+}
+
+// QueueFor returns the effective writer queue settings for a camera
+func (c *Config) QueueFor(cam CameraConfig) QueueConfig {
+	q := c.Queue.Merge(cam.Queue)
+
+	if q.Size == 0 {
+		q.Size = DefaultQueueSize
+	}
+	if q.Policy == "" {
+		q.Policy = DropNonKeyframes
+	}
+
+	return q
+}
+
+// TimelapseFor returns the effective timelapse settings for a camera
+func (c *Config) TimelapseFor(cam CameraConfig) TimelapseConfig {
+	t := c.Timelapse.Merge(cam.Timelapse)
+
+	if t.FrameRate == 0 {
+		t.FrameRate = DefaultTimelapseFrameRate
+	}
+	if t.Source == "" {
+		t.Source = TimelapseLive
+	}
+
+	return t
+}
+
+// ReadTimeoutFor returns the effective read timeout for a camera
+func (c *Config) ReadTimeoutFor(cam CameraConfig) time.Duration {
+	if cam.ReadTimeout > 0 {
+		return cam.ReadTimeout
+	}
+
+	return c.ReadTimeout
+}
+
+// StallTimeoutFor returns the effective stall timeout for a camera
+func (c *Config) StallTimeoutFor(cam CameraConfig) time.Duration {
+	if cam.StallTimeout > 0 {
+		return cam.StallTimeout
+	}
+
+	return c.StallTimeout
+}
+
+// ByteSize is a size in bytes that can be written in YAML either as a plain
+// number or with a unit suffix, e.g. 500MB or 2TB.
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// UnmarshalYAML parses sizes with an optional unit suffix
+func (b *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return errors.Wrapf(err, "invalid size %q", s)
+	}
+
+	*b = ByteSize(n * float64(mult))
+
+	return nil
+}
+
+const (
+	// DefaultStorageInterval is used when no storageInterval is configured
+	DefaultStorageInterval = 20 * time.Minute
+
+	// DefaultStoragePath is used when no storagePath is configured
+	DefaultStoragePath = "/tmp/go-surv"
+
+	// DefaultRetentionInterval is used when no retention interval is configured
+	DefaultRetentionInterval = 10 * time.Minute
+
+	// DefaultPreRoll is used for motion recording when no preRoll is configured
+	DefaultPreRoll = 5 * time.Second
+
+	// DefaultPostRoll is used for motion recording when no postRoll is configured
+	DefaultPostRoll = 10 * time.Second
+
+	// Defaults for motion detection
+	DefaultMotionThreshold = 25
+	DefaultMotionMinArea   = 0.01
+
+	// DefaultReadTimeout is used when no readTimeout is configured
+	DefaultReadTimeout = 10 * time.Second
+
+	// DefaultStallTimeout is used when no stallTimeout is configured
+	DefaultStallTimeout = 30 * time.Second
+
+	// DefaultTimelapseInterval is used for timelapses built on demand when
+	// no timelapse interval is configured
+	DefaultTimelapseInterval = time.Minute
+
+	// DefaultTimelapseFrameRate is used when no timelapse frameRate is
+	// configured
+	DefaultTimelapseFrameRate = 30
+
+	// DefaultQueueSize is used when no queue size is configured
+	DefaultQueueSize = 128
+
+	// DefaultStillQuality is used for JPEG and WebP stills without a quality
+	DefaultStillQuality = 80
+)
+
+// StillFormat is the image format stills are encoded in
+type StillFormat string
+
+const (
+	StillJPEG StillFormat = "jpeg"
+	StillPNG  StillFormat = "png"
+	StillWebP StillFormat = "webp"
+)
+
+// DecodeMode selects which video packets are decoded for frame writers
+type DecodeMode string
+
+const (
+	// DecodeAll decodes every frame
+	DecodeAll DecodeMode = "all"
+
+	// DecodeKeyframes decodes only keyframes, which can be decoded on
+	// their own, at most once per decode interval. Frame writers then only
+	// see a frame every GOP or so, plenty for stills.
+	DecodeKeyframes DecodeMode = "keyframes"
+)
+
+// DropPolicy decides what a writer queue does when it is full
+type DropPolicy string
+
+const (
+	// DropOldest discards the oldest queued item to make room
+	DropOldest DropPolicy = "dropOldest"
+
+	// DropNonKeyframes discards the rest of the GOP for packet writers, and
+	// frames not decoded from a keyframe for frame writers. Keyframes wait
+	// for room.
+	DropNonKeyframes DropPolicy = "dropNonKeyframes"
+
+	// Block waits for room, stalling the reader
+	Block DropPolicy = "block"
+)
+
+const (
+	// SegmentFormatFMP4 writes fragmented MP4 segments that remain playable
+	// if the process dies while recording
+	SegmentFormatFMP4 = "fmp4"
+
+	// SegmentFormatMP4 writes regular MP4 segments, finalized on close
+	SegmentFormatMP4 = "mp4"
+)
+
+const (
+	// StorageLocal keeps recorded segments in the storage path
+	StorageLocal = "local"
+
+	// StorageS3 uploads recorded segments to the configured S3 bucket
+	StorageS3 = "s3"
+)
+
+const (
+	// RecordContinuous records every segment
+	RecordContinuous = "continuous"
+
+	// RecordMotion only records while motion is detected
+	RecordMotion = "motion"
+)
+
+const (
+	// TimelapseLive samples frames from the live stream
+	TimelapseLive = "live"
+
+	// TimelapseArchive builds the previous day's timelapse from recorded
+	// segments after midnight
+	TimelapseArchive = "archive"
+)
+
 type AWSConfig struct {
 	// S3 bucket for storage
 	S3Bucket string `yaml:"s3bucket"`
@@ -56,6 +624,74 @@ func (a *AWSConfig) Ready() bool {
 	return true
 }
 
+// ValidateCamera checks a camera's settings against the global ones
+func (c *Config) ValidateCamera(cam CameraConfig) error {
+	if cam.Name == "" || cam.Source == "" {
+		return errors.New("cameras need a name and a source")
+	}
+
+	switch record := c.RecordFor(cam); record {
+	case RecordContinuous, RecordMotion:
+	default:
+		return errors.Errorf("unknown record mode %s for %s", record, cam.Name)
+	}
+
+	switch source := c.TimelapseFor(cam).Source; source {
+	case TimelapseLive, TimelapseArchive:
+	default:
+		return errors.Errorf("unknown timelapse source %s for %s", source, cam.Name)
+	}
+
+	switch policy := c.QueueFor(cam).Policy; policy {
+	case DropOldest, DropNonKeyframes, Block:
+	default:
+		return errors.Errorf("unknown queue policy %s for %s", policy, cam.Name)
+	}
+
+	still := c.StillFor(cam)
+	switch still.Format {
+	case StillJPEG, StillPNG, StillWebP:
+	default:
+		return errors.Errorf("unknown still format %s for %s", still.Format, cam.Name)
+	}
+
+	if still.Quality < 1 || still.Quality > 100 {
+		return errors.Errorf("still quality for %s must be between 1 and 100", cam.Name)
+	}
+
+	switch cam.Decode {
+	case "", DecodeAll, DecodeKeyframes:
+	default:
+		return errors.Errorf("unknown decode mode %s for %s", cam.Decode, cam.Name)
+	}
+
+	if cam.DecodeInterval != 0 && cam.Decode != DecodeKeyframes {
+		return errors.Errorf("decodeInterval for %s needs decode: keyframes", cam.Name)
+	}
+
+	if cam.Overlay != nil {
+		if err := cam.Overlay.validate(); err != nil {
+			return errors.Wrapf(err, "invalid overlay for %s", cam.Name)
+		}
+	}
+
+	if err := cam.validateMasks(); err != nil {
+		return errors.Wrapf(err, "invalid masks for %s", cam.Name)
+	}
+
+	if err := cam.validateInput(); err != nil {
+		return errors.Wrapf(err, "invalid input settings for %s", cam.Name)
+	}
+
+	if cam.Schedule != nil {
+		if _, err := cam.Schedule.Parse(); err != nil {
+			return errors.Wrapf(err, "error parsing schedule for %s", cam.Name)
+		}
+	}
+
+	return nil
+}
+
 func ParseConfig(fn string) (*Config, error) {
 	bytes, err := ioutil.ReadFile(fn)
 	if err != nil {
@@ -69,6 +705,58 @@ func ParseConfig(fn string) (*Config, error) {
 		return nil, errors.Wrap(err, "error deserializing configuration")
 	}
 
+	if cc.StorageInterval == 0 {
+		cc.StorageInterval = DefaultStorageInterval
+	}
+
+	if cc.StoragePath == "" {
+		cc.StoragePath = DefaultStoragePath
+	}
+
+	if cc.CatalogPath == "" {
+		cc.CatalogPath = filepath.Join(cc.StoragePath, "catalog.jsonl")
+	}
+
+	switch cc.SegmentFormat {
+	case "":
+		cc.SegmentFormat = SegmentFormatFMP4
+	case SegmentFormatFMP4, SegmentFormatMP4:
+	default:
+		return nil, errors.Errorf("unknown segment format %s", cc.SegmentFormat)
+	}
+
+	switch cc.Storage {
+	case "", StorageLocal, StorageS3:
+	default:
+		return nil, errors.Errorf("unknown storage %s", cc.Storage)
+	}
+
+	switch cc.Record {
+	case "", RecordContinuous, RecordMotion:
+	default:
+		return nil, errors.Errorf("unknown record mode %s", cc.Record)
+	}
+
+	if cc.ReadTimeout == 0 {
+		cc.ReadTimeout = DefaultReadTimeout
+	}
+
+	if cc.StallTimeout == 0 {
+		cc.StallTimeout = DefaultStallTimeout
+	}
+
+	if cc.Retention.Interval < 0 {
+		return nil, errors.New("retention interval must not be negative")
+	} else if cc.Retention.Interval == 0 {
+		cc.Retention.Interval = DefaultRetentionInterval
+	}
+
+	for _, cam := range cc.Cameras {
+		if err := cc.ValidateCamera(cam); err != nil {
+			return nil, err
+		}
+	}
+
 	return &cc, nil
 
 }
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"github.com/pkg/errors"
+)
+
+// RTSP transports accepted by the transport preset
+var transports = map[string]bool{
+	"tcp":           true,
+	"udp":           true,
+	"udp_multicast": true,
+	"http":          true,
+	"https":         true,
+}
+
+// InputOptions returns the FFmpeg options the camera's sources are opened
+// with: the options implied by its presets, overridden by any set
+// explicitly in options. The low latency preset's decoder flag isn't an
+// input option, see LowLatency.
+func (c CameraConfig) InputOptions() map[string]string {
+	opts := make(map[string]string)
+
+	if c.Transport != "" {
+		opts["rtsp_transport"] = c.Transport
+	}
+
+	if c.LowLatency {
+		opts["fflags"] = "nobuffer"
+	}
+
+	for k, v := range c.Options {
+		opts[k] = v
+	}
+
+	return opts
+}
+
+// validateInput checks the camera's input presets
+func (c CameraConfig) validateInput() error {
+	if c.Transport != "" && !transports[c.Transport] {
+		return errors.Errorf("unknown transport %s", c.Transport)
+	}
+
+	return nil
+}
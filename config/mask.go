@@ -0,0 +1,43 @@
+package config
+
+import (
+	"github.com/pkg/errors"
+)
+
+// MaskConfig is a privacy mask, a polygon blanked out of the camera's
+// frames. Points are x, y pairs in fractions of the frame's width and
+// height, 0, 0 being the top left corner.
+type MaskConfig struct {
+	Name   string       `yaml:"name" json:"name,omitempty"`
+	Points [][2]float64 `yaml:"points" json:"points"`
+}
+
+// Validate checks that the mask is a polygon inside the frame
+func (m MaskConfig) Validate() error {
+	if len(m.Points) < 3 {
+		return errors.Errorf("mask %s needs at least 3 points", m.Name)
+	}
+
+	for _, p := range m.Points {
+		if p[0] < 0 || p[0] > 1 || p[1] < 0 || p[1] > 1 {
+			return errors.Errorf("points of mask %s must be between 0 and 1", m.Name)
+		}
+	}
+
+	return nil
+}
+
+// validateMasks checks the camera's privacy masks
+func (c CameraConfig) validateMasks() error {
+	for _, m := range c.Masks {
+		if err := m.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.MaskRecordings && c.Decode == DecodeKeyframes {
+		return errors.New("masked recordings need every frame decoded")
+	}
+
+	return nil
+}
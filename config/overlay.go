@@ -0,0 +1,67 @@
+package config
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Overlay positions
+var overlayPositions = map[string]bool{
+	"top-left":     true,
+	"top-right":    true,
+	"bottom-left":  true,
+	"bottom-right": true,
+}
+
+// OverlayConfig burns the camera name and time into stills and, optionally,
+// re-encoded recordings. Zero values use the defaults.
+type OverlayConfig struct {
+	// top-left (default), top-right, bottom-left or bottom-right
+	Position string `yaml:"position"`
+
+	// Font size in pixels, 24 by default
+	FontSize int `yaml:"fontSize"`
+
+	// TrueType font, the fontconfig default if empty
+	FontFile string `yaml:"fontFile"`
+
+	// strftime format of the time, %Y-%m-%d %H:%M:%S by default. %Z and %z
+	// always show UTC.
+	Format string `yaml:"format"`
+
+	// IANA time zone, e.g. Europe/Berlin, the local time zone if empty
+	Timezone string `yaml:"timezone"`
+
+	// Also draw the overlay on re-encoded recordings: live timelapses and
+	// masked recordings
+	Recordings bool `yaml:"recordings"`
+}
+
+// Location returns the time zone the overlay shows the time in
+func (o OverlayConfig) Location() (*time.Location, error) {
+	if o.Timezone == "" {
+		return time.Local, nil
+	}
+
+	loc, err := time.LoadLocation(o.Timezone)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unknown time zone %s", o.Timezone)
+	}
+
+	return loc, nil
+}
+
+// validate checks the overlay settings
+func (o OverlayConfig) validate() error {
+	if o.Position != "" && !overlayPositions[o.Position] {
+		return errors.Errorf("unknown overlay position %s", o.Position)
+	}
+
+	if o.FontSize < 0 {
+		return errors.New("overlay font size must not be negative")
+	}
+
+	_, err := o.Location()
+	return err
+}
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ScheduleConfig limits recording to a set of weekly windows, e.g.
+//
+//   timezone: America/New_York
+//   windows:
+//   - mon-fri 18:00-08:00
+//   - sat,sun
+//
+// Each window is a list of days (names, ranges or *) followed by an
+// optional HH:MM-HH:MM time range; the whole day is used when the time
+// range is left out. Ranges ending before they start continue past
+// midnight into the next day.
+type ScheduleConfig struct {
+	// IANA time zone the windows are in, defaults to the local time zone
+	Timezone string `yaml:"timezone"`
+
+	// Windows during which recording is active
+	Windows []string `yaml:"windows"`
+}
+
+// Schedule is a parsed recording schedule
+type Schedule struct {
+	loc     *time.Location
+	windows []window
+}
+
+type window struct {
+	days [7]bool
+
+	// minutes after midnight, end is exclusive
+	start, end int
+}
+
+// Active returns true if t falls in any window of the schedule
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.loc)
+	day := t.Weekday()
+	prev := (day + 6) % 7
+	min := t.Hour()*60 + t.Minute()
+
+	for _, w := range s.windows {
+		if w.start < w.end {
+			if w.days[day] && min >= w.start && min < w.end {
+				return true
+			}
+			continue
+		}
+
+		// window wraps past midnight
+		if (w.days[day] && min >= w.start) || (w.days[prev] && min < w.end) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Parse parses the schedule
+func (sc *ScheduleConfig) Parse() (*Schedule, error) {
+	loc := time.Local
+	if sc.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(sc.Timezone); err != nil {
+			return nil, errors.Wrapf(err, "invalid timezone %s", sc.Timezone)
+		}
+	}
+
+	if len(sc.Windows) == 0 {
+		return nil, errors.New("schedule has no windows")
+	}
+
+	s := &Schedule{loc: loc}
+	for _, spec := range sc.Windows {
+		w, err := parseWindow(spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid schedule window %q", spec)
+		}
+		s.windows = append(s.windows, w)
+	}
+
+	return s, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseWindow(spec string) (window, error) {
+	var w window
+
+	fields := strings.Fields(strings.ToLower(spec))
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, errors.New("expected days and an optional time range")
+	}
+
+	for _, item := range strings.Split(fields[0], ",") {
+		if item == "*" {
+			for d := range w.days {
+				w.days[d] = true
+			}
+			continue
+		}
+
+		bounds := strings.SplitN(item, "-", 2)
+		first, ok := weekdays[bounds[0]]
+		if !ok {
+			return w, errors.Errorf("unknown day %s", bounds[0])
+		}
+
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[bounds[1]]; !ok {
+				return w, errors.Errorf("unknown day %s", bounds[1])
+			}
+		}
+
+		// ranges may wrap around the end of the week, e.g. fri-mon
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	w.start, w.end = 0, 24*60
+	if len(fields) == 1 || fields[1] == "*" {
+		return w, nil
+	}
+
+	bounds := strings.SplitN(fields[1], "-", 2)
+	if len(bounds) != 2 {
+		return w, errors.New("expected a time range like 08:00-18:00")
+	}
+
+	var err error
+	if w.start, err = parseClock(bounds[0]); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(bounds[1]); err != nil {
+		return w, err
+	}
+
+	if w.start == w.end {
+		return w, errors.New("time range is empty")
+	}
+
+	return w, nil
+}
+
+// parseClock parses HH:MM into minutes after midnight. 24:00 is accepted
+// as the end of the day.
+func parseClock(s string) (int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, errors.Errorf("invalid time %s, expected HH:MM", s)
+	}
+
+	h, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, errors.Errorf("invalid time %s, expected HH:MM", s)
+	}
+
+	m, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, errors.Errorf("invalid time %s, expected HH:MM", s)
+	}
+
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, errors.Errorf("time %s out of range", s)
+	}
+
+	return h*60 + m, nil
+}
@@ -0,0 +1,179 @@
+package http
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/thenrich/go-surv/config"
+	"github.com/thenrich/go-surv/video"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// maxCameraConfig bounds the size of a camera configuration in a request
+const maxCameraConfig = 64 << 10
+
+var adminPath = regexp.MustCompile("^/admin/cameras(?:/(?P<Camera>[a-zA-Z0-9_]+)(?:/(?P<Action>pause|resume|restart|masks))?)?$")
+
+func NewAdminHandler(cs video.CameraStreamer, token string) *AdminHandler {
+	return &AdminHandler{cameras: cs, token: token}
+}
+
+// AdminHandler changes cameras while streaming. Requests must carry the
+// configured token as "Authorization: Bearer [TOKEN]".
+//
+//   POST   /admin/cameras                adds a camera, the body is its
+//                                        configuration in YAML or JSON
+//   DELETE /admin/cameras/front_door     removes a camera
+//   POST   /admin/cameras/front_door/pause
+//   POST   /admin/cameras/front_door/resume
+//   POST   /admin/cameras/front_door/restart
+//   GET    /admin/cameras/front_door/masks  privacy masks as JSON
+//   PUT    /admin/cameras/front_door/masks  replaces the privacy masks
+type AdminHandler struct {
+	cameras video.CameraStreamer
+	token   string
+}
+
+func (ah *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !ah.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="go-surv"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	f := adminPath.FindStringSubmatch(r.URL.Path)
+	if len(f) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+	name, action := f[1], f[2]
+
+	var err error
+	switch {
+	case name == "" && r.Method == http.MethodPost:
+		ah.add(w, r)
+		return
+
+	case name != "" && action == "" && r.Method == http.MethodDelete:
+		err = ah.cameras.Remove(name)
+
+	case action == "masks":
+		ah.masks(w, r, name)
+		return
+
+	case action == "pause" && r.Method == http.MethodPost:
+		err = ah.cameras.Pause(name)
+
+	case action == "resume" && r.Method == http.MethodPost:
+		err = ah.cameras.Resume(name)
+
+	case action == "restart" && r.Method == http.MethodPost:
+		err = ah.cameras.Restart(name)
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if errors.Cause(err) == video.ErrUnknownCamera {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Println(errors.Wrapf(err, "error changing %s", name))
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorized returns true if the request carries the admin token
+func (ah *AdminHandler) authorized(r *http.Request) bool {
+	if ah.token == "" {
+		return false
+	}
+
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(ah.token)) == 1
+}
+
+// masks shows or replaces the privacy masks of a camera, e.g.
+//
+//   [{"name": "neighbour", "points": [[0.7, 0], [1, 0], [1, 0.4], [0.7, 0.4]]}]
+//
+// Points are fractions of the frame's width and height. Changes apply to
+// the next frame and aren't written back to the configuration file.
+func (ah *AdminHandler) masks(w http.ResponseWriter, r *http.Request, name string) {
+	cam := ah.cameras.Camera(name)
+	if cam == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(cam.Masks.Masks()); err != nil {
+			log.Println(errors.Wrapf(err, "error encoding masks of %s", name))
+		}
+
+	case http.MethodPut:
+		var masks []video.Mask
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCameraConfig)).Decode(&masks); err != nil {
+			http.Error(w, errors.Wrap(err, "invalid masks").Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := cam.Masks.Set(masks); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// add adds the camera configured in the request body
+func (ah *AdminHandler) add(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxCameraConfig))
+	if err != nil {
+		http.Error(w, "error reading camera configuration", http.StatusBadRequest)
+		return
+	}
+
+	var cam config.CameraConfig
+	if err := yaml.UnmarshalStrict(body, &cam); err != nil {
+		http.Error(w, errors.Wrap(err, "invalid camera configuration").Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !adminPath.MatchString("/admin/cameras/" + cam.Name) {
+		http.Error(w, "camera names may only contain letters, digits and underscores", http.StatusBadRequest)
+		return
+	}
+
+	err = ah.cameras.Add(cam)
+	if errors.Cause(err) == video.ErrCameraExists {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println(errors.Wrapf(err, "error adding %s", cam.Name))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
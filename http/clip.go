@@ -0,0 +1,91 @@
+package http
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/thenrich/go-surv/archive"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+)
+
+// maxClipLength bounds the footage a single request may export
+const maxClipLength = 6 * time.Hour
+
+var clipPath = regexp.MustCompile("cameras/(?P<Camera>[a-zA-Z0-9_]+)/clip$")
+
+func NewClipHandler(exporter *archive.Exporter) *ClipHandler {
+	return &ClipHandler{exporter}
+}
+
+// ClipHandler serves MP4 clips of recorded footage, e.g.
+// /cameras/front_door/clip?start=2018-05-01T10:00:00Z&end=2018-05-01T10:05:00Z
+type ClipHandler struct {
+	exporter *archive.Exporter
+}
+
+func (ch *ClipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f := clipPath.FindStringSubmatch(r.URL.Path)
+	if len(f) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	name := f[1]
+
+	start, err := time.Parse(time.RFC3339, r.URL.Query().Get("start"))
+	if err != nil {
+		http.Error(w, "invalid start, expected RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+
+	end, err := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
+	if err != nil {
+		http.Error(w, "invalid end, expected RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+
+	if !start.Before(end) {
+		http.Error(w, "start must be before end", http.StatusBadRequest)
+		return
+	}
+
+	if end.Sub(start) > maxClipLength {
+		http.Error(w, fmt.Sprintf("clips are limited to %s", maxClipLength), http.StatusBadRequest)
+		return
+	}
+
+	tmp, err := ioutil.TempFile("", "clip-")
+	if err != nil {
+		log.Println(errors.Wrap(err, "error creating temporary file"))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	err = ch.exporter.Export(name, start.UTC(), end.UTC(), tmp.Name())
+	if errors.Cause(err) == archive.ErrNoFootage {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Println(errors.Wrapf(err, "error exporting clip for %s", name))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	clip, err := os.Open(tmp.Name())
+	if err != nil {
+		log.Println(errors.Wrapf(err, "error opening %s", tmp.Name()))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer clip.Close()
+
+	filename := fmt.Sprintf("%s-%s.mp4", name, start.UTC().Format("2006-01-02-15-04-05"))
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	http.ServeContent(w, r, filename, time.Time{}, clip)
+}
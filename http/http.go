@@ -1,9 +1,16 @@
 package http
 
 import (
+	"bytes"
+	"github.com/pkg/errors"
 	"net/http"
+	"net/url"
 	"regexp"
 	"log"
+	"strconv"
+	"time"
+	"github.com/thenrich/go-surv/archive"
+	"github.com/thenrich/go-surv/config"
 	"github.com/thenrich/go-surv/video"
 )
 
@@ -11,6 +18,10 @@ func NewCameraHandler(cs video.CameraStreamer) *CameraHandler {
 	return &CameraHandler{cs}
 }
 
+// maxVariantSize bounds the width and height of resized stills. Stills are
+// only ever scaled down.
+const maxVariantSize = 4096
+
 type CameraHandler struct {
 	cameras video.CameraStreamer
 }
@@ -33,16 +44,104 @@ func (ch *CameraHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "image/jpeg")
-	w.Write(cam.LatestImage)
-	return
+	// the latest still, or the one nearest to ?at=RFC3339
+	var snapshot *video.Snapshot
+	if at := r.URL.Query().Get("at"); at != "" {
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			http.Error(w, "invalid at, expected RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		snapshot = cam.Snapshots.Nearest(t)
+	} else {
+		snapshot = cam.Snapshots.Latest()
+	}
+
+	if snapshot == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// ?width=320&height=180&format=jpeg&quality=70 asks for a resized variant
+	if opts, ok, err := variantOptions(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if ok {
+		snapshot, err = snapshot.Resize(opts)
+		if err != nil {
+			log.Println(errors.Wrapf(err, "error resizing still for %s", f[1]))
+			http.Error(w, "error resizing still", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", snapshot.ContentType)
+	w.Header().Set("ETag", snapshot.ETag())
+	w.Header().Set("X-Capture-Time", snapshot.Time.UTC().Format(time.RFC3339Nano))
+
+	// answers conditional requests
+	http.ServeContent(w, r, "", snapshot.Time, bytes.NewReader(snapshot.Data))
 
 }
 
-func NewHandler(cs video.CameraStreamer) http.Handler {
+// variantOptions parses the resize parameters of a still request, reporting
+// whether there are any. Missing parameters keep the still's format and
+// size.
+func variantOptions(r *http.Request) (video.StillOptions, bool, error) {
+	q := r.URL.Query()
+	opts := video.StillOptions{Quality: config.DefaultStillQuality}
+
+	var err error
+	if opts.MaxWidth, err = queryInt(q, "width", 1, maxVariantSize); err != nil {
+		return opts, false, err
+	}
+	if opts.MaxHeight, err = queryInt(q, "height", 1, maxVariantSize); err != nil {
+		return opts, false, err
+	}
+	if quality, err := queryInt(q, "quality", 1, 100); err != nil {
+		return opts, false, err
+	} else if quality != 0 {
+		opts.Quality = quality
+	}
+
+	if format := q.Get("format"); format != "" {
+		opts.Format = config.StillFormat(format)
+		if opts.ContentType() == "" {
+			return opts, false, errors.Errorf("unknown format %s", format)
+		}
+	}
+
+	ok := q.Get("width") != "" || q.Get("height") != "" || q.Get("format") != "" || q.Get("quality") != ""
+	return opts, ok, nil
+}
+
+// queryInt parses an optional integer query parameter between min and max,
+// zero if it is missing
+func queryInt(q url.Values, name string, min int, max int) (int, error) {
+	v := q.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil || i < min || i > max {
+		return 0, errors.Errorf("invalid %s, expected %d-%d", name, min, max)
+	}
+
+	return i, nil
+}
+
+// NewHandler creates the HTTP handler of the service. The admin endpoints
+// are only served with an admin token.
+func NewHandler(cs video.CameraStreamer, exporter *archive.Exporter, adminToken string) http.Handler {
 	h := NewRegexHandler()
+	if adminToken != "" {
+		h.Handle(adminPath, NewAdminHandler(cs, adminToken))
+	}
+	h.Handle(clipPath, NewClipHandler(exporter))
 	h.Handle(regexp.MustCompile("cameras/"), NewCameraHandler(cs))
 	h.Handle(regexp.MustCompile("dash$"), NewDashHandler())
+	h.Handle(regexp.MustCompile("^/status$"), NewStatusHandler(cs))
 
 	return h
 }
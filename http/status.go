@@ -0,0 +1,37 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/thenrich/go-surv/video"
+	"log"
+	"net/http"
+)
+
+func NewStatusHandler(cs video.CameraStreamer) *StatusHandler {
+	return &StatusHandler{cs}
+}
+
+// StatusHandler reports the health of every camera as JSON. The response
+// is a 503 while any camera isn't streaming so simple uptime checks can
+// alert on it.
+type StatusHandler struct {
+	cameras video.CameraStreamer
+}
+
+func (sh *StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	statuses := sh.cameras.Status()
+
+	code := http.StatusOK
+	for i := range statuses {
+		if !statuses[i].Healthy() {
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		log.Println(errors.Wrap(err, "error encoding status"))
+	}
+}
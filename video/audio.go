@@ -0,0 +1,175 @@
+package video
+
+import (
+	"github.com/3d0c/gmf"
+	"github.com/pkg/errors"
+)
+
+// audio codecs that can be copied into MP4 segments as is, everything else,
+// e.g. G.711 from most cameras, is transcoded to AAC
+var mp4AudioCodecs = map[string]bool{
+	"aac": true,
+	"mp3": true,
+}
+
+// aacBitRate is the bit rate audio is transcoded at
+const aacBitRate = 64000
+
+// needsTranscode returns true if an audio stream can't be stored in MP4 as
+// is
+func needsTranscode(ist *gmf.Stream) bool {
+	return !mp4AudioCodecs[codecName(ist)]
+}
+
+// audioTranscoder decodes an audio stream and re-encodes it as AAC
+type audioTranscoder struct {
+	ist *gmf.Stream
+
+	dec  *gmf.CodecCtx
+	enc  *gmf.CodecCtx
+	swr  *gmf.SwrCtx
+	fifo *gmf.AVAudioFifo
+
+	// timestamp of the next encoded frame, in samples. Starts at the
+	// timestamp of the first packet, or 0 if it has none.
+	pts int64
+}
+
+// Encoder returns the AAC encoder, used to set up output streams
+func (at *audioTranscoder) Encoder() *gmf.CodecCtx {
+	return at.enc
+}
+
+// Transcode decodes a packet from the source stream and returns the AAC
+// packets that became available, timestamped in the encoder's time base.
+// The caller owns the returned packets.
+func (at *audioTranscoder) Transcode(pkt *gmf.Packet) ([]*gmf.Packet, error) {
+	if at.pts == NoPTS {
+		at.pts = 0
+		if pkt.Pts() != NoPTS {
+			at.pts = gmf.RescaleQ(pkt.Pts(), at.ist.TimeBase(), at.enc.TimeBase())
+		}
+	}
+
+	frames, err := at.dec.Decode(pkt)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding audio")
+	}
+
+	for _, f := range frames {
+		converted, err := at.swr.Convert(f)
+		f.Free()
+		if err != nil {
+			return nil, errors.Wrap(err, "error resampling audio")
+		}
+
+		at.fifo.Write(converted)
+		converted.Free()
+	}
+
+	var packets []*gmf.Packet
+	size := at.enc.FrameSize()
+	for at.fifo.SamplesToRead() >= size {
+		frame := at.fifo.Read(size)
+		if frame == nil {
+			break
+		}
+		frame.SetChannelLayout(at.enc.GetDefaultChannelLayout(at.enc.Channels()))
+		frame.SetPts(at.pts)
+		at.pts += int64(size)
+
+		// Encode frees frame
+		encoded, err := at.enc.Encode([]*gmf.Frame{frame}, -1)
+		if err != nil {
+			frame.Free()
+			for _, p := range packets {
+				p.Free()
+			}
+			return nil, errors.Wrap(err, "error encoding audio")
+		}
+
+		packets = append(packets, encoded...)
+	}
+
+	return packets, nil
+}
+
+// Close frees the transcoder
+func (at *audioTranscoder) Close() {
+	at.fifo.Free()
+	at.swr.Free()
+	gmf.Release(at.enc)
+	gmf.Release(at.dec)
+}
+
+// newAudioTranscoder creates a transcoder from ist to AAC. The encoder
+// always produces global headers as required by MP4.
+func newAudioTranscoder(ist *gmf.Stream) (*audioTranscoder, error) {
+	par := ist.GetCodecPar()
+
+	codec, err := gmf.FindDecoder(par.GetCodecId())
+	if err != nil {
+		return nil, errors.Wrap(err, "error finding audio decoder")
+	}
+
+	dec := gmf.NewCodecCtx(codec)
+	if err := par.ToContext(dec); err != nil {
+		gmf.Release(dec)
+		return nil, errors.Wrap(err, "error copying audio codec parameters")
+	}
+
+	if err := dec.Open(nil); err != nil {
+		gmf.Release(dec)
+		return nil, errors.Wrap(err, "error opening audio decoder")
+	}
+
+	codec, err = gmf.FindEncoder("aac")
+	if err != nil {
+		gmf.Release(dec)
+		return nil, errors.Wrap(err, "error finding encoder")
+	}
+
+	channels := dec.Channels()
+	layout := dec.GetDefaultChannelLayout(channels)
+
+	enc := gmf.NewCodecCtx(codec)
+	enc.SetSampleFmt(gmf.AV_SAMPLE_FMT_FLTP).SetSampleRate(dec.SampleRate()).SetChannels(channels)
+	enc.SetChannelLayout(layout)
+	enc.SetBitRate(aacBitRate)
+	enc.SetTimeBase(gmf.AVR{Num: 1, Den: dec.SampleRate()})
+	enc.SetFlag(gmf.CODEC_FLAG_GLOBAL_HEADER)
+	if codec.IsExperimental() {
+		enc.SetStrictCompliance(gmf.FF_COMPLIANCE_EXPERIMENTAL)
+	}
+
+	if err := enc.Open(nil); err != nil {
+		gmf.Release(enc)
+		gmf.Release(dec)
+		return nil, errors.Wrap(err, "error opening audio encoder")
+	}
+
+	swr, err := gmf.NewSwrCtx([]*gmf.Option{
+		{Key: "in_channel_count", Val: channels},
+		{Key: "out_channel_count", Val: channels},
+		{Key: "in_channel_layout", Val: layout},
+		{Key: "out_channel_layout", Val: layout},
+		{Key: "in_sample_rate", Val: dec.SampleRate()},
+		{Key: "out_sample_rate", Val: dec.SampleRate()},
+		{Key: "in_sample_fmt", Val: gmf.SampleFormat(dec.SampleFmt())},
+		{Key: "out_sample_fmt", Val: gmf.SampleFormat(gmf.AV_SAMPLE_FMT_FLTP)},
+	}, channels, gmf.AV_SAMPLE_FMT_FLTP)
+	if err != nil {
+		gmf.Release(enc)
+		gmf.Release(dec)
+		return nil, errors.Wrap(err, "error creating resampler")
+	}
+
+	return &audioTranscoder{
+		ist:  ist,
+		dec:  dec,
+		enc:  enc,
+		swr:  swr,
+		fifo: gmf.NewAVAudioFifo(gmf.AV_SAMPLE_FMT_FLTP, channels, enc.FrameSize()),
+		pts:  NoPTS,
+	}, nil
+}
@@ -0,0 +1,87 @@
+package video
+
+/*
+
+#cgo pkg-config: libavformat libavcodec libavutil
+
+#include <stdlib.h>
+#include "libavformat/avformat.h"
+#include "libavcodec/avcodec.h"
+#include "libavutil/dict.h"
+
+*/
+import "C"
+
+import (
+	"reflect"
+	"unsafe"
+
+	"github.com/3d0c/gmf"
+	"github.com/pkg/errors"
+)
+
+// avCodecFlagLowDelay is AV_CODEC_FLAG_LOW_DELAY, which gmf doesn't export
+var avCodecFlagLowDelay = int(C.AV_CODEC_FLAG_LOW_DELAY)
+
+// openInput opens url in ctx with the given FFmpeg options and returns the
+// keys of the options the input didn't take. gmf only opens inputs without
+// options, so the format context is opened here.
+func openInput(ctx *gmf.FmtCtx, url string, options []gmf.Pair) ([]string, error) {
+	avCtx, err := formatContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var dict *C.AVDictionary
+	defer C.av_dict_free(&dict)
+
+	for _, o := range options {
+		ckey := C.CString(o.Key)
+		cval := C.CString(o.Val)
+		ret := C.av_dict_set(&dict, ckey, cval, 0)
+		C.free(unsafe.Pointer(ckey))
+		C.free(unsafe.Pointer(cval))
+
+		if ret < 0 {
+			return nil, errors.Wrapf(gmf.AvError(int(ret)), "error setting option %s", o.Key)
+		}
+	}
+
+	curl := C.CString(url)
+	defer C.free(unsafe.Pointer(curl))
+
+	// frees the context and clears ctx's pointer to it on failure
+	if ret := C.avformat_open_input(avCtx, curl, nil, &dict); ret < 0 {
+		return nil, errors.Wrap(gmf.AvError(int(ret)), "error opening input")
+	}
+
+	if ret := C.avformat_find_stream_info(*avCtx, nil); ret < 0 {
+		return nil, errors.Wrap(gmf.AvError(int(ret)), "error finding stream info")
+	}
+
+	// options are left in the dictionary unless the input took them
+	var unused []string
+	empty := C.CString("")
+	defer C.free(unsafe.Pointer(empty))
+
+	var entry *C.AVDictionaryEntry
+	for {
+		if entry = C.av_dict_get(dict, empty, entry, C.AV_DICT_IGNORE_SUFFIX); entry == nil {
+			break
+		}
+		unused = append(unused, C.GoString(entry.key))
+	}
+
+	return unused, nil
+}
+
+// formatContext returns the address of the AVFormatContext pointer held by
+// ctx, which gmf keeps unexported
+func formatContext(ctx *gmf.FmtCtx) (**C.AVFormatContext, error) {
+	f := reflect.ValueOf(ctx).Elem().FieldByName("avCtx")
+	if !f.IsValid() || f.Kind() != reflect.Ptr {
+		return nil, errors.New("unsupported gmf format context")
+	}
+
+	return (**C.AVFormatContext)(unsafe.Pointer(f.UnsafeAddr())), nil
+}
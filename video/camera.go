@@ -1,62 +1,186 @@
 package video
 
 import (
-	"github.com/pkg/errors"
+	"sort"
+	"sync"
 	"time"
 	"log"
+	"github.com/pkg/errors"
 	"github.com/thenrich/go-surv/config"
 )
 
+var (
+	// ErrUnknownCamera is returned for cameras that aren't configured
+	ErrUnknownCamera = errors.New("unknown camera")
+
+	// ErrCameraExists is returned when adding a camera whose name is taken
+	ErrCameraExists = errors.New("camera already exists")
+)
+
 // CameraStreamer defines the behavior for camera handlers
 type CameraStreamer interface {
 	Camera(name string) *Camera
 	StartStreams()
+	Status() []Status
+
+	// Change cameras while streaming
+	Add(cfg config.CameraConfig) error
+	Remove(name string) error
+	Pause(name string) error
+	Resume(name string) error
+	Restart(name string) error
 }
 
+// CameraFactory creates a camera and its writers from its configuration
+type CameraFactory func(cfg config.CameraConfig) (*Camera, error)
+
 type Camera struct {
 	// Name of camera
 	Name string
 
-	// Latest still image in JPEG format
-	LatestImage []byte
+	// Recent still images
+	Snapshots *SnapshotStore
+
+	// Format, quality and size of still images
+	Still StillOptions
 
 	// SourceURL defines the video source
 	SourceURL string
 
+	// Optional low resolution stream of the same camera. When set, only
+	// the substream is decoded for stills and frame writers while
+	// recorders remux SourceURL.
+	SubSourceURL string
+
+	// Amount of footage kept in memory ahead of event-based recordings
+	PreRoll time.Duration
+
+	// Socket timeout for connecting to and reading from the source
+	ReadTimeout time.Duration
+
+	// Restart the stream when no packet arrives for this long, zero to
+	// disable
+	StallTimeout time.Duration
+
+	// Record audio along with video
+	Audio bool
+
+	// FFmpeg options used when opening the sources
+	InputOptions map[string]string
+
+	// Decode with the low delay flag set
+	LowDelay bool
+
+	// Which frames are decoded for stills and other frame writers, and the
+	// minimum time between decoded keyframes
+	Decode         config.DecodeMode
+	DecodeInterval time.Duration
+
+	// Camera name and time burnt into stills and overlaid writers, nil for
+	// none. OverlayRecordings also draws it for recording writers.
+	Overlay           *OverlayOptions
+	OverlayRecordings bool
+
+	// Privacy masks blanked out of every decoded frame
+	Masks *MaskSet
+
+	// Size of the queue feeding each writer and what to do once it's full
+	QueueSize  int
+	DropPolicy config.DropPolicy
+
 	// interval to record
 	recordInterval time.Duration
 
 	// writers
 	writers []Writer
+
+	// frame writers getting frames with the overlay, if there is one
+	overlaid []Writer
+
+	// frame writers recording the main stream, e.g. re-encoding recorders
+	recorders []Writer
+
+	// writers consuming encoded packets, e.g. recorders
+	packetWriters []PacketWriter
 }
 
-// AddWriter adds packet writers to this camera
+// AddWriter adds frame writers to this camera
 func (c *Camera) AddWriter(w Writer) {
 	c.writers = append(c.writers, w)
 }
 
+// AddOverlaidWriter adds frame writers receiving frames with the camera's
+// overlay drawn on, or plain frames if it has none
+func (c *Camera) AddOverlaidWriter(w Writer) {
+	c.overlaid = append(c.overlaid, w)
+}
+
+// AddRecordingWriter adds frame writers fed from the main stream even if the
+// camera has a substream, e.g. recorders re-encoding masked video
+func (c *Camera) AddRecordingWriter(w Writer) {
+	c.recorders = append(c.recorders, w)
+}
+
+// AddPacketWriter adds packet writers to this camera
+func (c *Camera) AddPacketWriter(w PacketWriter) {
+	c.packetWriters = append(c.packetWriters, w)
+}
+
 // NewCamera creates a new camera instance
 func NewCamera(name string, source string, recordInterval time.Duration) *Camera {
-	return &Camera{Name: name, SourceURL: source, recordInterval: recordInterval}
+	return &Camera{
+		Name:           name,
+		SourceURL:      source,
+		Snapshots:      NewSnapshotStore(DefaultSnapshotHistory),
+		Still:          StillOptions{Format: config.StillJPEG, Quality: config.DefaultStillQuality},
+		QueueSize:      config.DefaultQueueSize,
+		DropPolicy:     config.DropNonKeyframes,
+		Decode:         config.DecodeAll,
+		Masks:          &MaskSet{},
+		recordInterval: recordInterval,
+	}
 }
 
 type CameraHandler struct {
 	cfg *config.Config
 
+	// creates cameras added at runtime
+	factory CameraFactory
+
+	// called with the configuration of each camera added at runtime
+	added func(cfg config.CameraConfig)
+
+	// guards the fields below, cameras are added and removed while the
+	// handler is serving
+	mu sync.RWMutex
+
+	// whether StartStreams has been called
+	started bool
+
 	// cameras we're monitoring
 	cameras map[string]*Camera
 
 	// streams for all cameras we're monitoring, indexed by
 	// camera name
 	streams map[string]*Stream
+
+	// substreams of the cameras that have one, indexed by camera name
+	subStreams map[string]*Stream
 }
 
 func (ch *CameraHandler) AddCamera(cam *Camera) {
 	log.Printf("Add camera %s %s", cam.Name, cam.SourceURL)
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
 	ch.cameras[cam.Name] = cam
 }
 
 func (ch *CameraHandler) Camera(name string) *Camera {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
 	if _, ok := ch.cameras[name]; ok {
 		return ch.cameras[name]
 	}
@@ -64,71 +188,283 @@ func (ch *CameraHandler) Camera(name string) *Camera {
 	return nil
 }
 
+// SetFactory sets the function used to create cameras added at runtime
+func (ch *CameraHandler) SetFactory(factory CameraFactory) {
+	ch.factory = factory
+}
+
+// OnAdd sets a function called once a camera has been added at runtime
+func (ch *CameraHandler) OnAdd(added func(cfg config.CameraConfig)) {
+	ch.added = added
+}
+
 // StartStreams sets up the streams for each camera and begins reading
 // camera data.
 func (ch *CameraHandler) StartStreams() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
 	// Create the streams and add writers
-	ch.setupStreams()
+	for _, cam := range ch.cameras {
+		if err := ch.setupStreams(cam); err != nil {
+			log.Println(errors.Wrapf(err, "error setting up streams for %s", cam.Name))
+		}
+	}
 
 	ch.stream()
-
+	ch.started = true
 }
 
-// iterate over all of our streams and start each one
+// iterate over all of our streams and start each one. Must be called with
+// mu held.
 func (ch *CameraHandler) stream() {
 	for _, stream := range ch.streams {
 		stream.Start()
 	}
 
+	for _, stream := range ch.subStreams {
+		stream.Start()
+	}
 }
 
-func (ch *CameraHandler) setupStreams() {
-	// Setup streams for each camera,
-	for _, cam := range ch.cameras {
-		log.Printf("Setup stream for %s", cam.Name)
-		stream := NewStream(cam)
+// setupStreams creates the streams of a camera. Must be called with mu
+// held.
+func (ch *CameraHandler) setupStreams(cam *Camera) error {
+	log.Printf("Setup stream for %s", cam.Name)
+	stream := NewStream(cam, cam.SourceURL)
 
-		// open camera streams
-		if err := stream.Open(); err != nil {
-			log.Fatal(errors.Wrap(err, "error opening stream"))
-		}
+	// frames are decoded from the substream if the camera has one,
+	// the main stream is only remuxed
+	decoded := stream
+	var sub *Stream
+	if cam.SubSourceURL != "" {
+		log.Printf("Setup substream for %s", cam.Name)
+		sub = NewStream(cam, cam.SubSourceURL)
+		decoded = sub
+	}
+
+	// setup still writer
+	// @TODO should the Stills channel be on a stream or the writer?
+	still, err := NewStillWriter(decoded.Stills(), cam.Still)
+	if err != nil {
+		return err
+	}
+	// Frame writers get frames with the privacy masks blanked out, only
+	// stills and the writers asking for it get the overlay. They are
+	// attached to the source once it has been opened.
+	decoded.AddWriter(NewFilterWriter(cam.Name, cam.Masks, cam.Overlay, append([]Writer{still}, cam.overlaid...)...))
 
+	if len(cam.writers) > 0 {
+		decoded.AddWriter(NewFilterWriter(cam.Name, cam.Masks, nil, cam.writers...))
+	}
 
-		// setup still writer
-		// @TODO should the Stills channel be on a stream or the writer?
-		still, err := NewStillWriter(stream.Stills())
-		if err != nil {
-			log.Println(err)
-			continue
+	if len(cam.recorders) > 0 {
+		var overlay *OverlayOptions
+		if cam.OverlayRecordings {
+			overlay = cam.Overlay
 		}
-		still.SetCodecContext(stream.demuxer.srcVideo.CodecCtx())
-		still.SetTimeBase(stream.demuxer.srcVideo.TimeBase())
-		stream.AddWriter(still)
-		//// Add all of the camera writers to the stream
-		//for _, w := range cam.writers {
-		//	stream.AddWriter(w)
-		//}
-		//
-		ch.streams[cam.Name] = stream
-		//
-		go func(stream *Stream, cam *Camera) {
-			for {
-				select {
-				case s := <-stream.Stills():
-					cam.LatestImage = s.imgData
-				}
+		stream.AddWriter(NewFilterWriter(cam.Name, cam.Masks, overlay, cam.recorders...))
+	}
+
+	for _, w := range cam.packetWriters {
+		stream.AddPacketWriter(w)
+	}
+
+	ch.streams[cam.Name] = stream
+	if sub != nil {
+		ch.subStreams[cam.Name] = sub
+	}
+	//
+	go func(stream *Stream, cam *Camera) {
+		for {
+			select {
+			case s := <-stream.Stills():
+				cam.Snapshots.Add(&Snapshot{
+					Data:        s.imgData,
+					ContentType: s.contentType,
+					Time:        s.time,
+					Width:       s.width,
+					Height:      s.height,
+				})
+			case <-stream.done:
+				return
 			}
-		}(stream, cam)
+		}
+	}(decoded, cam)
+
+	return nil
+}
+
+// Add creates a camera from its configuration and starts streaming from it
+func (ch *CameraHandler) Add(cfg config.CameraConfig) error {
+	if ch.factory == nil {
+		return errors.New("cameras can't be added at runtime")
+	}
+
+	if err := ch.cfg.ValidateCamera(cfg); err != nil {
+		return err
 	}
+
+	if err := cfg.ValidateRemote(); err != nil {
+		return err
+	}
+
+	if ch.Camera(cfg.Name) != nil {
+		return ErrCameraExists
+	}
+
+	cam, err := ch.factory(cfg)
+	if err != nil {
+		return errors.Wrapf(err, "error creating camera %s", cfg.Name)
+	}
+
+	log.Printf("Add camera %s %s", cam.Name, cam.SourceURL)
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if _, ok := ch.cameras[cam.Name]; ok {
+		return ErrCameraExists
+	}
+	ch.cameras[cam.Name] = cam
+
+	// set up with the others otherwise
+	if ch.started {
+		if err := ch.setupStreams(cam); err != nil {
+			delete(ch.cameras, cam.Name)
+			return errors.Wrapf(err, "error setting up streams for %s", cam.Name)
+		}
+
+		ch.streams[cam.Name].Start()
+		if sub, ok := ch.subStreams[cam.Name]; ok {
+			sub.Start()
+		}
+	}
+
+	if ch.added != nil {
+		ch.added(cfg)
+	}
+
+	return nil
+}
+
+// Remove stops streaming from a camera, finalizing its recordings, and
+// forgets it
+func (ch *CameraHandler) Remove(name string) error {
+	ch.mu.Lock()
+	if _, ok := ch.cameras[name]; !ok {
+		ch.mu.Unlock()
+		return ErrUnknownCamera
+	}
+
+	streams := ch.cameraStreams(name)
+	delete(ch.cameras, name)
+	delete(ch.streams, name)
+	delete(ch.subStreams, name)
+	ch.mu.Unlock()
+
+	log.Printf("Remove camera %s", name)
+	for _, stream := range streams {
+		stream.Cleanup()
+	}
+
+	return nil
+}
+
+// Pause stops reading from a camera until it is resumed
+func (ch *CameraHandler) Pause(name string) error {
+	return ch.each(name, (*Stream).Pause)
+}
+
+// Resume reopens a paused camera
+func (ch *CameraHandler) Resume(name string) error {
+	return ch.each(name, (*Stream).Resume)
+}
+
+// Restart reopens a camera, e.g. after changing its settings on the camera
+func (ch *CameraHandler) Restart(name string) error {
+	return ch.each(name, (*Stream).Restart)
+}
+
+// each calls f for every stream of a camera
+func (ch *CameraHandler) each(name string, f func(s *Stream)) error {
+	ch.mu.RLock()
+	_, ok := ch.cameras[name]
+	streams := ch.cameraStreams(name)
+	ch.mu.RUnlock()
+
+	if !ok {
+		return ErrUnknownCamera
+	}
+
+	if len(streams) == 0 {
+		return errors.Errorf("streams for %s are not running", name)
+	}
+
+	for _, stream := range streams {
+		f(stream)
+	}
+
+	return nil
+}
+
+// cameraStreams returns a camera's stream and substream, if any. Must be
+// called with mu held.
+func (ch *CameraHandler) cameraStreams(name string) []*Stream {
+	var streams []*Stream
+	if stream, ok := ch.streams[name]; ok {
+		streams = append(streams, stream)
+	}
+
+	if sub, ok := ch.subStreams[name]; ok {
+		streams = append(streams, sub)
+	}
+
+	return streams
+}
+
+// Status returns the health of every camera's stream, ordered by name
+func (ch *CameraHandler) Status() []Status {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	statuses := make([]Status, 0, len(ch.streams))
+	for name, stream := range ch.streams {
+		st := stream.Status()
+		if sub, ok := ch.subStreams[name]; ok {
+			subStatus := sub.Status()
+			st.Substream = &subStatus
+		}
+		statuses = append(statuses, st)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	return statuses
 }
 
 func (ch *CameraHandler) CloseStreams() {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
 	for name, stream := range ch.streams {
 		log.Printf("Cleaning up stream for %s\n", name)
 		stream.Cleanup()
 	}
+
+	for name, stream := range ch.subStreams {
+		log.Printf("Cleaning up substream for %s\n", name)
+		stream.Cleanup()
+	}
 }
 
 func NewCameraHandler(cfg *config.Config) *CameraHandler {
-	return &CameraHandler{cfg, make(map[string]*Camera), make(map[string]*Stream)}
+	return &CameraHandler{
+		cfg:        cfg,
+		cameras:    make(map[string]*Camera),
+		streams:    make(map[string]*Stream),
+		subStreams: make(map[string]*Stream),
+	}
 }
@@ -5,19 +5,34 @@ import (
 	"github.com/pkg/errors"
 	"io"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type demuxer struct {
 	// URL to read from
 	url string
 
-	inputCtx    *gmf.FmtCtx
-	srcVideo    *gmf.Stream
-	inputStream *gmf.Stream
-	codecCtx    *gmf.CodecCtx
+	// socket timeout for RTSP sources, zero to wait forever
+	timeout time.Duration
 
-	// video stream index
-	videoStreamIndex int
+	// whether to read the audio stream
+	audio bool
+
+	// FFmpeg options the input is opened with
+	options map[string]string
+
+	// decode with AV_CODEC_FLAG_LOW_DELAY
+	lowDelay bool
+
+	// time the last keyframe was decoded in keyframe decode mode
+	lastDecode time.Time
+
+	inputCtx *gmf.FmtCtx
+	srcVideo *gmf.Stream
+	srcAudio *gmf.Stream
 
 	// Images
 	imgCodecCtx *gmf.CodecCtx
@@ -26,108 +41,190 @@ type demuxer struct {
 	// Video
 }
 
-func (d *demuxer) ReadFrames() ([]*gmf.Frame, error) {
+// ReadPacket reads the next packet belonging to the video stream, or the
+// audio stream if enabled. Packets from other streams are discarded. Any
+// error, including io.EOF once the camera closes the session, means the
+// source has to be reopened.
+func (d *demuxer) ReadPacket() (*gmf.Packet, error) {
 	// Loop until we get a good pkt
-	//var err error
-	var pkt *gmf.Packet
-	var frames []*gmf.Frame
 	for {
-		var err error
-		pkt, err = d.inputCtx.GetNextPacket()
-		if err != nil && err != io.EOF {
+		pkt, err := d.inputCtx.GetNextPacket()
+		if err != nil {
 			if pkt != nil {
 				pkt.Free()
 			}
 
-			log.Println(errors.Wrap(err, "error getting packet, continue"))
-			continue
-		} else if err != nil && pkt == nil {
-			log.Println(errors.Wrap(err, "error and nil packet, continue"))
-			continue
-		}
+			if err == io.EOF {
+				// the camera closed the session
+				return nil, err
+			}
 
-		if err == io.EOF {
-			log.Println(errors.Wrap(err, "reached EOF"))
-			return nil, err
+			// the source is gone
+			return nil, errors.Wrap(err, "error getting packet")
 		}
 
-		if pkt != nil && pkt.StreamIndex() != d.srcVideo.Index() {
-			log.Println("pkt from wrong stream, continue")
+		if pkt == nil {
+			log.Println("nil packet after read, continue")
 			continue
 		}
 
-		if pkt == nil {
-			log.Println("nil packet after read frames, continue")
+		if pkt.StreamIndex() != d.srcVideo.Index() && (d.srcAudio == nil || pkt.StreamIndex() != d.srcAudio.Index()) {
+			log.Println("pkt from wrong stream, continue")
+			pkt.Free()
 			continue
 		}
 
-		frames, err = d.inputStream.CodecCtx().Decode(pkt)
-		if err != nil {
-			log.Println(errors.Wrap(err, "fatal error during decoding, continue"))
-			continue
+		return pkt, nil
+	}
+}
 
-		}
-		if len(frames) == 0 {
-			continue
-		}
+// Decode decodes a video packet into zero or more frames. The decoder is
+// opened with the first packet, sources that are only remuxed never open
+// one.
+func (d *demuxer) Decode(pkt *gmf.Packet) ([]*gmf.Frame, error) {
+	frames, err := d.decoder().Decode(pkt)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding packet")
+	}
 
-		break
+	return frames, nil
+}
+
+// decoder returns the decoder of the video stream, opening it on first use
+func (d *demuxer) decoder() *gmf.CodecCtx {
+	if d.lowDelay && !d.srcVideo.IsCodecCtxSet() {
+		if cc, err := d.openLowDelayDecoder(); err != nil {
+			log.Println(errors.Wrapf(err, "error opening low delay decoder for %s", d.url))
+		} else {
+			d.srcVideo.SetCodecCtx(cc)
+		}
 	}
 
-	//if frames, err = gmf.DefaultRescaler(d.imgSwsCtx, frames); err != nil {
-	//	return nil, errors.Wrap(err, "error rescaling")
-	//}
+	return d.srcVideo.CodecCtx()
+}
 
+// openLowDelayDecoder opens a decoder for the video stream that outputs
+// frames as soon as possible
+func (d *demuxer) openLowDelayDecoder() (*gmf.CodecCtx, error) {
+	par := d.srcVideo.GetCodecPar()
 
-	if pkt != nil {
-		pkt.Free()
-		pkt = nil
+	codec, err := gmf.FindDecoder(par.GetCodecId())
+	if err != nil {
+		return nil, errors.Wrap(err, "error finding decoder")
 	}
 
-	return frames, nil
+	cc := gmf.NewCodecCtx(codec)
+	if err := par.ToContext(cc); err != nil {
+		gmf.Release(cc)
+		return nil, errors.Wrap(err, "error copying codec parameters")
+	}
+	cc.SetTimeBase(d.srcVideo.TimeBase().AVR())
+	cc.SetFlag(avCodecFlagLowDelay)
+
+	if err := cc.Open(nil); err != nil {
+		gmf.Release(cc)
+		return nil, errors.Wrap(err, "error opening decoder")
+	}
 
+	return cc, nil
 }
 
 func (d *demuxer) open() error {
-	ctx, err := gmf.NewInputCtx(d.url)
+	ctx := gmf.NewCtx()
+
+	var pairs []gmf.Pair
+	if d.timeout > 0 && (strings.HasPrefix(d.url, "rtsp://") || strings.HasPrefix(d.url, "rtsps://")) {
+		// in microseconds, applies to connecting as well as reading
+		pairs = append(pairs, gmf.Pair{Key: "stimeout", Val: strconv.FormatInt(int64(d.timeout/time.Microsecond), 10)})
+	}
+
+	// added after the timeout so an explicit stimeout wins
+	pairs = append(pairs, inputOptions(d.options)...)
+
+	unused, err := openInput(ctx, d.url, pairs)
 	if err != nil {
+		ctx.Free()
 		return errors.Wrapf(err, "error opening %s\n", d.url)
 	}
 
-	srcVideo, err := ctx.GetBestStream(gmf.AVMEDIA_TYPE_VIDEO)
-	if err != nil {
-		return errors.Wrapf(err, "error finding stream\n")
+	if len(unused) > 0 {
+		log.Printf("Options %s not used by %s\n", strings.Join(unused, ", "), d.url)
 	}
 
-	inputStream, err := ctx.GetStream(srcVideo.Index())
+	srcVideo, err := ctx.GetBestStream(gmf.AVMEDIA_TYPE_VIDEO)
 	if err != nil {
-		return errors.Wrap(err, "error getting stream")
+		ctx.Free()
+		return errors.Wrapf(err, "error finding stream\n")
 	}
 
 	d.inputCtx = ctx
 	d.srcVideo = srcVideo
-	d.videoStreamIndex = srcVideo.Index()
-	d.inputStream = inputStream
-	d.codecCtx = srcVideo.CodecCtx()
-
 
+	if d.audio {
+		srcAudio, err := ctx.GetBestStream(gmf.AVMEDIA_TYPE_AUDIO)
+		if err != nil {
+			log.Printf("No audio stream in %s, recording video only\n", d.url)
+		} else {
+			d.srcAudio = srcAudio
+		}
+	}
 
 	return nil
 }
 
 func (d *demuxer) Close() error {
+	// the decoder is opened lazily on the first Decode
+	if d.srcVideo.IsCodecCtxSet() {
+		gmf.Release(d.srcVideo.CodecCtx())
+	}
+
 	d.inputCtx.Free()
-	d.inputStream.Free()
-	d.imgCodecCtx.Free()
-	d.imgSwsCtx.Free()
-	gmf.Release(d.imgCodecCtx)
+	d.srcVideo.Free()
+	if d.srcAudio != nil {
+		d.srcAudio.Free()
+	}
+
+	if d.imgSwsCtx != nil {
+		d.imgSwsCtx.Free()
+	}
+	if d.imgCodecCtx != nil {
+		gmf.Release(d.imgCodecCtx)
+	}
 
 	return nil
 }
 
-func NewDemuxer(url string) *demuxer {
+// codecName returns the name of a stream's codec without opening a decoder
+func codecName(st *gmf.Stream) string {
+	codec, err := gmf.FindDecoder(st.GetCodecPar().GetCodecId())
+	if err != nil {
+		return ""
+	}
+
+	return codec.Name()
+}
+
+// inputOptions converts options to dictionary entries, sorted by key
+func inputOptions(options map[string]string) []gmf.Pair {
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]gmf.Pair, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, gmf.Pair{Key: k, Val: options[k]})
+	}
+
+	return pairs
+}
+
+func NewDemuxer(url string, timeout time.Duration, audio bool) *demuxer {
 	return &demuxer{
-		url: url,
+		url:     url,
+		timeout: timeout,
+		audio:   audio,
 	}
 }
 
@@ -0,0 +1,288 @@
+package video
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/3d0c/gmf"
+	"github.com/pkg/errors"
+)
+
+// encodingGOP is the keyframe interval of re-encoded recordings, in frames.
+// Recorders only start segments at keyframes.
+const encodingGOP = 50
+
+// EncodingWriter is a frame writer re-encoding frames to H.264 for a
+// recorder, so that what's drawn onto the frames, e.g. privacy masks, ends
+// up in the recordings. Audio isn't recorded.
+type EncodingWriter struct {
+	name string
+	w    PacketWriter
+
+	mu sync.Mutex
+
+	codecCtx *gmf.CodecCtx
+	timebase gmf.AVRational
+
+	// pre-roll of the encoded stream, if the recorder takes one
+	ring *PacketRing
+
+	// set while encoding. ost belongs to a null muxer and describes the
+	// encoded stream to the recorder.
+	encCtx    *gmf.CodecCtx
+	swsCtx    *gmf.SwsCtx
+	outputCtx *gmf.FmtCtx
+	ost       *gmf.Stream
+	lastPts   int64
+}
+
+func (ew *EncodingWriter) SetTimeBase(tb gmf.AVRational) {
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+
+	ew.timebase = tb
+}
+
+// SetCodecContext finishes the recording of the previous source
+func (ew *EncodingWriter) SetCodecContext(ctx *gmf.CodecCtx) error {
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+
+	var err error
+	if ew.encCtx != nil {
+		err = ew.close()
+	}
+	ew.codecCtx = ctx
+
+	return err
+}
+
+// open creates the encoder for the current source and opens the recorder
+// against it
+func (ew *EncodingWriter) open() error {
+	codec, err := gmf.FindEncoder("libx264")
+	if err != nil {
+		return errors.Wrap(err, "error finding encoder")
+	}
+
+	// yuv420p needs even dimensions
+	width, height := ew.codecCtx.Width()&^1, ew.codecCtx.Height()&^1
+
+	cc := gmf.NewCodecCtx(codec)
+	cc.SetTimeBase(ew.timebase.AVR())
+	cc.SetPixFmt(gmf.AV_PIX_FMT_YUV420P).SetWidth(width).SetHeight(height)
+	cc.SetGopSize(encodingGOP)
+	cc.SetOptions([]gmf.Option{{Key: "preset", Val: "veryfast"}, {Key: "crf", Val: "23"}, {Key: "tune", Val: "zerolatency"}})
+
+	// recorders write MP4
+	cc.SetFlag(gmf.CODEC_FLAG_GLOBAL_HEADER)
+
+	if err := cc.Open(nil); err != nil {
+		gmf.Release(cc)
+		return errors.Wrap(err, "error opening codec")
+	}
+
+	outputCtx, err := gmf.NewOutputCtxWithFormatName("", "null")
+	if err != nil {
+		gmf.Release(cc)
+		return errors.Wrap(err, "error creating output context")
+	}
+
+	ost, err := outputCtx.AddStreamWithCodeCtx(cc)
+	if err != nil {
+		outputCtx.Free()
+		gmf.Release(cc)
+		return errors.Wrap(err, "error creating output stream")
+	}
+	ost.SetTimeBase(ew.timebase.AVR())
+
+	var swsCtx *gmf.SwsCtx
+	if ew.codecCtx.PixFmt() != gmf.AV_PIX_FMT_YUV420P || width != ew.codecCtx.Width() || height != ew.codecCtx.Height() {
+		swsCtx, err = gmf.NewSwsCtx(
+			ew.codecCtx.Width(),
+			ew.codecCtx.Height(),
+			ew.codecCtx.PixFmt(),
+			width,
+			height,
+			gmf.AV_PIX_FMT_YUV420P,
+			gmf.SWS_BICUBIC)
+		if err != nil {
+			outputCtx.Free()
+			gmf.Release(cc)
+			return errors.Wrap(err, "error create sws ctx")
+		}
+	}
+
+	if err := ew.w.Open(ost, nil); err != nil {
+		if swsCtx != nil {
+			swsCtx.Free()
+		}
+		outputCtx.Free()
+		gmf.Release(cc)
+		return errors.Wrapf(err, "error opening recorder for %s", ew.name)
+	}
+
+	if ew.ring != nil {
+		ew.ring.Reset()
+		ew.ring.SetVideoStream(ost.Index())
+	}
+
+	ew.encCtx = cc
+	ew.swsCtx = swsCtx
+	ew.outputCtx = outputCtx
+	ew.ost = ost
+	ew.lastPts = NoPTS
+
+	return nil
+}
+
+// Write encodes frames and writes the packets to the recorder. The frames
+// aren't freed.
+func (ew *EncodingWriter) Write(frames []*gmf.Frame) error {
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+
+	if len(frames) == 0 {
+		return nil
+	}
+
+	if ew.codecCtx == nil {
+		return errors.New("encoding writer has no codec context")
+	}
+
+	if ew.encCtx == nil {
+		if err := ew.open(); err != nil {
+			return err
+		}
+	}
+
+	in := make([]*gmf.Frame, 0, len(frames))
+	for _, f := range frames {
+		var frame *gmf.Frame
+		if ew.swsCtx != nil {
+			frame = gmf.NewFrame().SetWidth(ew.encCtx.Width()).SetHeight(ew.encCtx.Height()).SetFormat(gmf.AV_PIX_FMT_YUV420P)
+			if err := frame.ImgAlloc(); err != nil {
+				frame.Free()
+				for _, f := range in {
+					f.Free()
+				}
+				return errors.Wrap(err, "error allocating frame")
+			}
+			ew.swsCtx.Scale(f, frame)
+		} else {
+			frame = f.CloneNewFrame()
+		}
+
+		// the encoder needs increasing timestamps
+		pts := f.Pts()
+		if ew.lastPts != NoPTS && (pts == NoPTS || pts <= ew.lastPts) {
+			pts = ew.lastPts + 1
+		} else if pts == NoPTS {
+			pts = 0
+		}
+		ew.lastPts = pts
+		frame.SetPts(pts)
+
+		// keyframes follow the encoder's GOP, not the source's
+		frame.SetPictType(gmf.AV_PICTURE_TYPE_NONE)
+
+		in = append(in, frame)
+	}
+
+	var packets []*gmf.Packet
+	for i, frame := range in {
+		// Encode frees frame unless it fails
+		encoded, err := ew.encCtx.Encode([]*gmf.Frame{frame}, -1)
+		if err != nil {
+			for _, f := range in[i:] {
+				f.Free()
+			}
+			for _, p := range packets {
+				p.Free()
+			}
+			return errors.Wrap(err, "error encoding")
+		}
+
+		packets = append(packets, encoded...)
+	}
+
+	return ew.writePackets(packets)
+}
+
+// writePackets passes encoded packets to the recorder and frees them
+func (ew *EncodingWriter) writePackets(packets []*gmf.Packet) error {
+	var err error
+	for _, p := range packets {
+		if err == nil {
+			p.SetStreamIndex(ew.ost.Index())
+			err = ew.w.WritePacket(p)
+
+			if ew.ring != nil {
+				ew.ring.Push(p)
+			}
+		}
+		p.Free()
+	}
+
+	return err
+}
+
+// close flushes the encoder and closes the recorder
+func (ew *EncodingWriter) close() error {
+	packets, err := ew.encCtx.Encode(nil, 1)
+	if err == nil {
+		err = ew.writePackets(packets)
+	}
+	err = errors.Wrap(err, "error flushing encoder")
+
+	if cerr := ew.w.Close(); cerr != nil {
+		if err != nil {
+			log.Println(err)
+		}
+		err = cerr
+	}
+
+	ew.outputCtx.Free()
+	gmf.Release(ew.encCtx)
+	if ew.swsCtx != nil {
+		ew.swsCtx.Free()
+	}
+
+	ew.encCtx = nil
+	ew.swsCtx = nil
+	ew.outputCtx = nil
+	ew.ost = nil
+
+	return err
+}
+
+// Close finishes the recording, it resumes with the next frame
+func (ew *EncodingWriter) Close() error {
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+
+	if ew.encCtx == nil {
+		return nil
+	}
+
+	return ew.close()
+}
+
+// String names the writer after the recorder it feeds, e.g. in queue status
+func (ew *EncodingWriter) String() string {
+	return "video.EncodingWriter(" + writerName(ew.w) + ")"
+}
+
+// NewEncodingWriter creates a writer re-encoding frames for a recorder.
+// Recorders taking a pre-roll get preRoll of the encoded stream.
+func NewEncodingWriter(name string, w PacketWriter, preRoll time.Duration) *EncodingWriter {
+	ew := &EncodingWriter{name: name, w: w}
+
+	if pw, ok := w.(PreRollWriter); ok && preRoll > 0 {
+		ew.ring = NewPacketRing(preRoll)
+		pw.SetPreRoll(ew.ring)
+	}
+
+	return ew
+}
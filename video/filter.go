@@ -0,0 +1,336 @@
+package video
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3d0c/gmf"
+	"github.com/pkg/errors"
+)
+
+// FilterWriter blanks out privacy masks and draws the overlay, if any, onto
+// decoded frames with an FFmpeg filter graph and passes them on to its
+// writers. The graph runs once for all of them and is rebuilt when the masks
+// change. Without masks or overlay frames are passed on untouched.
+type FilterWriter struct {
+	name    string
+	masks   *MaskSet
+	overlay *OverlayOptions
+	writers []Writer
+
+	mu sync.Mutex
+
+	// source the graph is fed from and its decoder
+	src      *gmf.Stream
+	codecCtx *gmf.CodecCtx
+
+	// describes the filtered frames, which are YUV 4:2:0 at the source's
+	// size
+	filteredCtx *gmf.CodecCtx
+
+	// whether the writers are set up for filtered frames
+	filtering bool
+
+	// built with the first frame from a source, for a version of the masks
+	filter  *gmf.Filter
+	version int
+
+	// frames are fed to the graph with the wall clock time as pts, which
+	// map back to their original pts. fed holds the wall clock pts of the
+	// frames in the graph in the order they were added.
+	origPts map[int64]int64
+	fed     []int64
+}
+
+// SetStream sets the source stream the filter graph is configured from
+func (fw *FilterWriter) SetStream(st *gmf.Stream) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.release()
+	fw.src = st
+}
+
+// SetTimeBase passes the source time base on to the writers
+func (fw *FilterWriter) SetTimeBase(tb gmf.AVRational) {
+	for _, w := range fw.writers {
+		if tw, ok := w.(timeBaseSetter); ok {
+			tw.SetTimeBase(tb)
+		}
+	}
+}
+
+// SetCodecContext sets the source's decoder and passes the writers the codec
+// context of the frames they get
+func (fw *FilterWriter) SetCodecContext(ctx *gmf.CodecCtx) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.release()
+	fw.codecCtx = ctx
+
+	codec, err := gmf.FindDecoder("rawvideo")
+	if err != nil {
+		return errors.Wrap(err, "error finding rawvideo codec")
+	}
+
+	cc := gmf.NewCodecCtx(codec)
+	cc.SetPixFmt(gmf.AV_PIX_FMT_YUV420P).SetWidth(ctx.Width()).SetHeight(ctx.Height())
+
+	masks, _ := fw.masks.current()
+	err = fw.setFiltering(fw.overlay != nil || len(masks) > 0, cc)
+
+	if fw.filteredCtx != nil {
+		gmf.Release(fw.filteredCtx)
+	}
+	fw.filteredCtx = cc
+
+	return err
+}
+
+// setFiltering points the writers at filtered frames described by
+// filteredCtx, or at the source's frames
+func (fw *FilterWriter) setFiltering(filtering bool, filteredCtx *gmf.CodecCtx) error {
+	ctx := fw.codecCtx
+	if filtering {
+		ctx = filteredCtx
+	}
+	fw.filtering = filtering
+
+	var first error
+	for _, w := range fw.writers {
+		if err := w.SetCodecContext(ctx); err != nil && first == nil {
+			first = errors.Wrapf(err, "error setting codec context for %s", writerName(w))
+		}
+	}
+
+	return first
+}
+
+// Write filters frames and writes them to every writer, the overlay shows
+// the current time
+func (fw *FilterWriter) Write(frames []*gmf.Frame) error {
+	return fw.WriteTimed(frames, time.Now())
+}
+
+// WriteTimed filters frames read from the source at read and writes them to
+// every writer, the overlay shows read
+func (fw *FilterWriter) WriteTimed(frames []*gmf.Frame, read time.Time) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if len(frames) == 0 {
+		return nil
+	}
+
+	if fw.src == nil || fw.codecCtx == nil {
+		return errors.New("filter writer has no source stream")
+	}
+
+	masks, version := fw.masks.current()
+	if fw.filter != nil && version != fw.version {
+		fw.release()
+	}
+
+	filtering := fw.overlay != nil || len(masks) > 0
+	if filtering != fw.filtering {
+		if err := fw.setFiltering(filtering, fw.filteredCtx); err != nil {
+			return err
+		}
+	}
+
+	if !filtering {
+		return fw.write(frames, read)
+	}
+
+	if fw.filter == nil {
+		if err := fw.open(masks); err != nil {
+			return err
+		}
+		fw.version = version
+	}
+
+	// drawtext shows the pts as the time, the original ones are restored
+	// for the writers whenever the graph returns the frames
+	wallClock := fw.pts(read)
+	for _, f := range frames {
+		// each wall clock pts maps to a single frame
+		for {
+			if _, ok := fw.origPts[wallClock]; !ok {
+				break
+			}
+			wallClock++
+		}
+
+		pts := f.Pts()
+		f.SetPts(wallClock)
+
+		// the filter takes over the frame's data, it's freed by the queue
+		if err := fw.filter.AddFrame(f, 0, gmf.AV_BUFFERSRC_FLAG_PUSH); err != nil {
+			return errors.Wrap(err, "error adding frame to filter")
+		}
+
+		fw.origPts[wallClock] = pts
+		fw.fed = append(fw.fed, wallClock)
+	}
+
+	// GetFrame always reports why it stopped, it only fails without frames
+	filtered, err := fw.filter.GetFrame()
+	if filtered == nil {
+		return errors.Wrap(err, "error filtering frames")
+	}
+
+	for _, f := range filtered {
+		f.SetPts(fw.restorePts(f.Pts()))
+	}
+
+	err = fw.write(filtered, read)
+
+	for _, f := range filtered {
+		f.Free()
+	}
+
+	return err
+}
+
+// restorePts returns the original pts of the frame fed to the graph with
+// the wall clock pts, or NoPTS if it's unknown. Frames fed before it were
+// dropped by the graph and are forgotten.
+func (fw *FilterWriter) restorePts(wallClock int64) int64 {
+	pts, ok := fw.origPts[wallClock]
+	if !ok {
+		return NoPTS
+	}
+
+	for i, k := range fw.fed {
+		delete(fw.origPts, k)
+		if k == wallClock {
+			fw.fed = fw.fed[i+1:]
+			break
+		}
+	}
+
+	return pts
+}
+
+// write passes frames read from the source at read to every writer
+func (fw *FilterWriter) write(frames []*gmf.Frame, read time.Time) error {
+	var first error
+	for _, w := range fw.writers {
+		var err error
+		if tw, ok := w.(timedWriter); ok {
+			err = tw.WriteTimed(frames, read)
+		} else {
+			err = w.Write(frames)
+		}
+
+		if err != nil && first == nil {
+			first = errors.Wrapf(err, "error writing to %s", writerName(w))
+		}
+	}
+
+	return first
+}
+
+// open builds the filter graph for masks and the overlay
+func (fw *FilterWriter) open(masks []Mask) error {
+	var chain []string
+
+	if len(masks) > 0 {
+		path, err := writeMaskImage(masks, fw.codecCtx.Width(), fw.codecCtx.Height())
+		if err != nil {
+			return err
+		}
+		// the movie source reads the image while the graph is built
+		defer os.Remove(path)
+
+		chain = append(chain, maskFilterDesc(path))
+	}
+
+	if fw.overlay != nil {
+		chain = append(chain, fw.overlay.filterDesc(fw.name))
+	}
+
+	// the writers expect the pixel format of filteredCtx, not the source's
+	chain = append(chain, "format=yuv420p")
+
+	filter, err := gmf.NewFilter(strings.Join(chain, ","), []*gmf.Stream{fw.src}, nil, nil)
+	if err != nil {
+		if filter != nil {
+			filter.Release()
+		}
+		return errors.Wrap(err, "error creating filter")
+	}
+	fw.filter = filter
+
+	return nil
+}
+
+// pts returns t as wall clock time in the overlay's zone, in the source's
+// time base, so drawtext shows it as UTC time
+func (fw *FilterWriter) pts(t time.Time) int64 {
+	if fw.overlay != nil && fw.overlay.Location != nil {
+		t = t.In(fw.overlay.Location)
+	}
+	_, offset := t.Zone()
+
+	us := t.Add(time.Duration(offset)*time.Second).UnixNano() / int64(time.Microsecond)
+	return gmf.RescaleQ(us, gmf.AV_TIME_BASE_Q, fw.src.TimeBase())
+}
+
+// release frees the filter graph, it is rebuilt with the next frame. Frames
+// held by the graph are lost.
+func (fw *FilterWriter) release() {
+	if fw.filter != nil {
+		fw.filter.Release()
+		fw.filter = nil
+	}
+
+	for _, k := range fw.fed {
+		delete(fw.origPts, k)
+	}
+	fw.fed = nil
+}
+
+// Close frees the filter graph and closes the writers
+func (fw *FilterWriter) Close() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.release()
+
+	var first error
+	for _, w := range fw.writers {
+		if err := w.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// String names the writer after the writers it feeds, e.g. in queue status
+func (fw *FilterWriter) String() string {
+	names := make([]string, len(fw.writers))
+	for i, w := range fw.writers {
+		names[i] = writerName(w)
+	}
+
+	return fmt.Sprintf("video.FilterWriter(%s)", strings.Join(names, ", "))
+}
+
+// NewFilterWriter creates a writer applying masks, which may be nil, and
+// drawing overlay, unless nil, onto the frames for writers. name is drawn
+// as the camera's name.
+func NewFilterWriter(name string, masks *MaskSet, overlay *OverlayOptions, writers ...Writer) *FilterWriter {
+	return &FilterWriter{
+		name:    name,
+		masks:   masks,
+		overlay: overlay,
+		writers: writers,
+		origPts: make(map[int64]int64),
+	}
+}
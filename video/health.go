@@ -0,0 +1,121 @@
+package video
+
+import (
+	"time"
+)
+
+// State describes the health of a camera's stream
+type State string
+
+const (
+	// StateConnecting is used until the source has been opened once
+	StateConnecting State = "connecting"
+
+	// StateStreaming means packets are arriving from the source
+	StateStreaming State = "streaming"
+
+	// StateStalled means no packet arrived within the stall timeout and
+	// the stream is being restarted
+	StateStalled State = "stalled"
+
+	// StateReconnecting means the source failed and is being reopened
+	StateReconnecting State = "reconnecting"
+
+	// StatePaused means the stream was paused and the source is closed
+	StatePaused State = "paused"
+
+	// StateFailed means the source could not be reopened after several
+	// attempts. Attempts continue in the background.
+	StateFailed State = "failed"
+)
+
+// failedAttempts is the number of consecutive failed connection attempts
+// after which a stream is reported as failed
+const failedAttempts = 5
+
+// Status is a snapshot of a camera's health
+type Status struct {
+	// Camera name
+	Name string `json:"name"`
+
+	State State `json:"state"`
+
+	// Time the last packet was read, nil if none has been
+	LastFrame *time.Time `json:"lastFrame,omitempty"`
+
+	// Most recent error reading from the source
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+
+	// Number of times the source was lost and reopened
+	Reconnects int `json:"reconnects"`
+
+	// Time the current connection was opened, nil while disconnected
+	ConnectedSince *time.Time `json:"connectedSince,omitempty"`
+
+	// Seconds since the current connection was opened
+	Uptime float64 `json:"uptime"`
+
+	// Queues feeding the stream's writers
+	Queues []QueueStatus `json:"queues,omitempty"`
+
+	// Health of the camera's substream, if it has one
+	Substream *Status `json:"substream,omitempty"`
+}
+
+// Healthy returns true if the camera and its substream are streaming or
+// were paused on purpose
+func (st *Status) Healthy() bool {
+	if st.Substream != nil && !st.Substream.Healthy() {
+		return false
+	}
+
+	return st.State == StateStreaming || st.State == StatePaused
+}
+
+// Status returns a snapshot of the stream's health
+func (s *Stream) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := Status{
+		Name:       s.cam.Name,
+		State:      s.state,
+		LastError:  s.lastError,
+		Reconnects: s.reconnects,
+	}
+
+	if !s.lastPacket.IsZero() {
+		t := s.lastPacket
+		st.LastFrame = &t
+	}
+
+	if !s.lastErrorTime.IsZero() {
+		t := s.lastErrorTime
+		st.LastErrorTime = &t
+	}
+
+	if s.connected {
+		t := s.connectedSince
+		st.ConnectedSince = &t
+		st.Uptime = time.Since(t).Seconds()
+	}
+
+	for _, q := range s.packetQueues {
+		st.Queues = append(st.Queues, q.Status())
+	}
+
+	for _, q := range s.frameQueues {
+		st.Queues = append(st.Queues, q.Status())
+	}
+
+	return st
+}
+
+// fail records an error and moves the stream to state. Must be called with
+// mu held.
+func (s *Stream) fail(state State, err error) {
+	s.state = state
+	s.lastError = err.Error()
+	s.lastErrorTime = time.Now()
+}
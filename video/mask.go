@@ -0,0 +1,139 @@
+package video
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/thenrich/go-surv/config"
+)
+
+// Mask is a polygon blanked out of every decoded frame. Points are fractions
+// of the frame's width and height, 0,0 being the top left corner, so masks
+// don't depend on the resolution of the stream.
+type Mask config.MaskConfig
+
+// MaskSet holds the privacy masks of a camera. They may be changed while
+// streaming and are safe for concurrent use.
+type MaskSet struct {
+	mu    sync.RWMutex
+	masks []Mask
+
+	// incremented on every change so filters know to rebuild
+	version int
+}
+
+// Masks returns a copy of the masks
+func (ms *MaskSet) Masks() []Mask {
+	masks, _ := ms.current()
+	return masks
+}
+
+// Set replaces the masks, taking effect with the next frame
+func (ms *MaskSet) Set(masks []Mask) error {
+	for _, m := range masks {
+		if err := config.MaskConfig(m).Validate(); err != nil {
+			return err
+		}
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.masks = copyMasks(masks)
+	ms.version++
+
+	return nil
+}
+
+// current returns a copy of the masks and their version. A nil set has no
+// masks.
+func (ms *MaskSet) current() ([]Mask, int) {
+	if ms == nil {
+		return nil, 0
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	return copyMasks(ms.masks), ms.version
+}
+
+func copyMasks(masks []Mask) []Mask {
+	c := make([]Mask, len(masks))
+	for i, m := range masks {
+		c[i] = Mask{Name: m.Name, Points: append([][2]float64(nil), m.Points...)}
+	}
+
+	return c
+}
+
+// maskImage draws masks opaque black onto a transparent width x height
+// image
+func maskImage(masks []Mask, width int, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	black := color.NRGBA{A: 0xff}
+
+	for _, m := range masks {
+		n := len(m.Points)
+
+		// even-odd scanline fill, sampling the center of each pixel
+		for y := 0; y < height; y++ {
+			cy := (float64(y) + 0.5) / float64(height)
+
+			var xs []float64
+			for i := 0; i < n; i++ {
+				a, b := m.Points[i], m.Points[(i+1)%n]
+				if (a[1] > cy) == (b[1] > cy) {
+					continue
+				}
+				xs = append(xs, a[0]+(cy-a[1])*(b[0]-a[0])/(b[1]-a[1]))
+			}
+			sort.Float64s(xs)
+
+			for i := 0; i+1 < len(xs); i += 2 {
+				from := int(math.Ceil(xs[i]*float64(width) - 0.5))
+				to := int(math.Floor(xs[i+1]*float64(width) - 0.5))
+				for x := from; x <= to && x < width; x++ {
+					if x >= 0 {
+						img.SetNRGBA(x, y, black)
+					}
+				}
+			}
+		}
+	}
+
+	return img
+}
+
+// writeMaskImage writes the masks as a width x height PNG to a temporary
+// file, returning its path
+func writeMaskImage(masks []Mask, width int, height int) (string, error) {
+	f, err := ioutil.TempFile("", "go-surv-mask-*.png")
+	if err != nil {
+		return "", errors.Wrap(err, "error creating mask image")
+	}
+
+	err = png.Encode(f, maskImage(masks, width, height))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrap(err, "error writing mask image")
+	}
+
+	return f.Name(), nil
+}
+
+// maskFilterDesc returns the filter graph drawing the mask image at path over
+// the input
+func maskFilterDesc(path string) string {
+	return "movie=" + filterQuote("filename="+filterQuote(path)) + "[mask];[in][mask]overlay=0:0"
+}
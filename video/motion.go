@@ -0,0 +1,280 @@
+package video
+
+import (
+	"sync"
+	"time"
+
+	"github.com/3d0c/gmf"
+	"github.com/pkg/errors"
+)
+
+const (
+	// size frames are reduced to before they are compared
+	motionWidth  = 64
+	motionHeight = 36
+
+	// minimum time between analyzed frames
+	motionCheckInterval = 200 * time.Millisecond
+)
+
+// MotionDetector is a frame writer that compares successive frames at a
+// low resolution and reports when enough pixels have changed.
+type MotionDetector struct {
+	mu sync.Mutex
+
+	codecCtx *gmf.CodecCtx
+
+	// minimum change in brightness for a pixel to count as changed
+	threshold int
+
+	// fraction of changed pixels that counts as motion
+	minArea float64
+
+	// grayscale conversion
+	swsCtx *gmf.SwsCtx
+	encCtx *gmf.CodecCtx
+
+	prev       []byte
+	lastCheck  time.Time
+	lastMotion time.Time
+}
+
+func (md *MotionDetector) SetCodecContext(ctx *gmf.CodecCtx) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	md.codecCtx = ctx
+	md.release()
+
+	return nil
+}
+
+// open creates the scaler and the raw encoder used to read back the
+// reduced frames
+func (md *MotionDetector) open() error {
+	codec, err := gmf.FindEncoder("rawvideo")
+	if err != nil {
+		return errors.Wrap(err, "error finding encoder")
+	}
+
+	cc := gmf.NewCodecCtx(codec)
+	cc.SetTimeBase(gmf.AVR{Num: 1, Den: 1000})
+	cc.SetPixFmt(gmf.AV_PIX_FMT_GRAY8).SetWidth(motionWidth).SetHeight(motionHeight)
+	if err := cc.Open(nil); err != nil {
+		gmf.Release(cc)
+		return errors.Wrap(err, "error opening codec")
+	}
+
+	swsCtx, err := gmf.NewSwsCtx(
+		md.codecCtx.Width(),
+		md.codecCtx.Height(),
+		md.codecCtx.PixFmt(),
+		motionWidth,
+		motionHeight,
+		gmf.AV_PIX_FMT_GRAY8,
+		gmf.SWS_FAST_BILINEAR)
+	if err != nil {
+		gmf.Release(cc)
+		return errors.Wrap(err, "error create sws ctx")
+	}
+
+	md.encCtx = cc
+	md.swsCtx = swsCtx
+
+	return nil
+}
+
+// release frees the scaler and encoder
+func (md *MotionDetector) release() {
+	if md.swsCtx != nil {
+		md.swsCtx.Free()
+		md.swsCtx = nil
+	}
+
+	if md.encCtx != nil {
+		gmf.Release(md.encCtx)
+		md.encCtx = nil
+	}
+
+	md.prev = nil
+}
+
+// Write compares the newest frame with the previously analyzed one
+func (md *MotionDetector) Write(frames []*gmf.Frame) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	now := time.Now()
+	if len(frames) == 0 || now.Sub(md.lastCheck) < motionCheckInterval {
+		return nil
+	}
+	md.lastCheck = now
+
+	if md.codecCtx == nil {
+		return errors.New("motion detector has no codec context")
+	}
+
+	if md.encCtx == nil {
+		if err := md.open(); err != nil {
+			return err
+		}
+	}
+
+	gray := gmf.NewFrame().SetWidth(motionWidth).SetHeight(motionHeight).SetFormat(gmf.AV_PIX_FMT_GRAY8)
+	if err := gray.ImgAlloc(); err != nil {
+		gray.Free()
+		return errors.Wrap(err, "error allocating frame")
+	}
+	md.swsCtx.Scale(frames[len(frames)-1], gray)
+
+	// Encode frees gray
+	packets, err := md.encCtx.Encode([]*gmf.Frame{gray}, -1)
+	if err != nil {
+		gray.Free()
+		return errors.Wrap(err, "error encoding")
+	}
+
+	for _, p := range packets {
+		md.compare(p.Data(), now)
+		p.Free()
+	}
+
+	return nil
+}
+
+// compare counts the pixels that changed since the previous image
+func (md *MotionDetector) compare(img []byte, now time.Time) {
+	prev := md.prev
+	md.prev = img
+
+	if len(prev) != len(img) || len(img) == 0 {
+		return
+	}
+
+	changed := 0
+	for i := range img {
+		d := int(img[i]) - int(prev[i])
+		if d < 0 {
+			d = -d
+		}
+		if d >= md.threshold {
+			changed++
+		}
+	}
+
+	if float64(changed)/float64(len(img)) >= md.minArea {
+		md.lastMotion = now
+	}
+}
+
+// LastMotion returns the time motion was last detected
+func (md *MotionDetector) LastMotion() time.Time {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	return md.lastMotion
+}
+
+func (md *MotionDetector) Close() error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	md.release()
+
+	return nil
+}
+
+// NewMotionDetector creates a motion detector. threshold is the minimum
+// change in brightness (0-255) for a pixel to count as changed and minArea
+// the fraction of changed pixels (0-1) that counts as motion.
+func NewMotionDetector(threshold int, minArea float64) *MotionDetector {
+	return &MotionDetector{threshold: threshold, minArea: minArea}
+}
+
+// MotionWriter passes packets to a recorder only while motion is detected.
+// Each event is written as its own segment, padded with the stream's
+// pre-roll and followed by postRoll of footage after motion stops.
+type MotionWriter struct {
+	PacketWriter
+
+	detector *MotionDetector
+	postRoll time.Duration
+	ring     *PacketRing
+
+	// whether an event is being recorded
+	recording bool
+}
+
+// SetPreRoll sets the ring written at the start of each event
+func (mw *MotionWriter) SetPreRoll(ring *PacketRing) {
+	mw.ring = ring
+}
+
+// WritePacket starts, continues or ends an event depending on when motion
+// was last detected.
+func (mw *MotionWriter) WritePacket(pkt *gmf.Packet) error {
+	active := time.Since(mw.detector.LastMotion()) < mw.postRoll
+
+	if !mw.recording {
+		if !active {
+			return nil
+		}
+
+		mw.recording = true
+		if err := mw.writePreRoll(pkt); err != nil {
+			return err
+		}
+
+		return mw.PacketWriter.WritePacket(pkt)
+	}
+
+	if !active {
+		mw.recording = false
+
+		// finalizes the event's segment
+		return mw.PacketWriter.Close()
+	}
+
+	return mw.PacketWriter.WritePacket(pkt)
+}
+
+// Close finalizes the current event, if any
+func (mw *MotionWriter) Close() error {
+	mw.recording = false
+
+	return mw.PacketWriter.Close()
+}
+
+// writePreRoll writes the packets buffered ahead of next, the first packet
+// of the event. The ring may already hold packets following next while the
+// writer's queue catches up; those are left to arrive through the queue.
+func (mw *MotionWriter) writePreRoll(next *gmf.Packet) error {
+	if mw.ring == nil {
+		return nil
+	}
+
+	packets := mw.ring.Packets()
+	defer func() {
+		for _, p := range packets {
+			p.Free()
+		}
+	}()
+
+	for _, p := range packets {
+		if p.StreamIndex() == next.StreamIndex() && p.Dts() != NoPTS && next.Dts() != NoPTS && p.Dts() >= next.Dts() {
+			break
+		}
+
+		if err := mw.PacketWriter.WritePacket(p); err != nil {
+			return errors.Wrap(err, "error writing pre-roll")
+		}
+	}
+
+	return nil
+}
+
+// NewMotionWriter wraps a recorder so it only records while the detector
+// reports motion
+func NewMotionWriter(w PacketWriter, detector *MotionDetector, postRoll time.Duration) *MotionWriter {
+	return &MotionWriter{PacketWriter: w, detector: detector, postRoll: postRoll}
+}
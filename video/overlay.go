@@ -0,0 +1,97 @@
+package video
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// OverlayPosition is the corner the overlay is drawn in
+type OverlayPosition string
+
+const (
+	OverlayTopLeft     OverlayPosition = "top-left"
+	OverlayTopRight    OverlayPosition = "top-right"
+	OverlayBottomLeft  OverlayPosition = "bottom-left"
+	OverlayBottomRight OverlayPosition = "bottom-right"
+)
+
+const (
+	// DefaultOverlayFontSize is used for overlays without a font size
+	DefaultOverlayFontSize = 24
+
+	// DefaultOverlayFormat is used for overlays without a time format
+	DefaultOverlayFormat = "%Y-%m-%d %H:%M:%S"
+
+	// distance of the overlay from the frame's edges, in pixels
+	overlayMargin = 10
+)
+
+// overlayPositions maps positions to drawtext x and y expressions
+var overlayPositions = map[OverlayPosition][2]string{
+	OverlayTopLeft:     {fmt.Sprint(overlayMargin), fmt.Sprint(overlayMargin)},
+	OverlayTopRight:    {fmt.Sprintf("w-tw-%d", overlayMargin), fmt.Sprint(overlayMargin)},
+	OverlayBottomLeft:  {fmt.Sprint(overlayMargin), fmt.Sprintf("h-th-%d", overlayMargin)},
+	OverlayBottomRight: {fmt.Sprintf("w-tw-%d", overlayMargin), fmt.Sprintf("h-th-%d", overlayMargin)},
+}
+
+// OverlayOptions configures the camera name and time burnt into frames
+type OverlayOptions struct {
+	Position OverlayPosition
+	FontSize int
+
+	// TrueType font, the fontconfig default if empty
+	FontFile string
+
+	// strftime format of the time, %Z and %z always show UTC
+	Format string
+
+	// time zone the time is shown in, local time if nil
+	Location *time.Location
+}
+
+// filterDesc returns the filter graph drawing name and the time
+func (o OverlayOptions) filterDesc(name string) string {
+	pos, ok := overlayPositions[o.Position]
+	if !ok {
+		pos = overlayPositions[OverlayTopLeft]
+	}
+
+	size := o.FontSize
+	if size <= 0 {
+		size = DefaultOverlayFontSize
+	}
+
+	format := o.Format
+	if format == "" {
+		format = DefaultOverlayFormat
+	}
+
+	// frames carry the wall clock time of the overlay's zone as their pts,
+	// see FilterWriter.Write
+	text := drawtextEscaper.Replace(name) + " %{pts:gmtime:0:" + filterQuote(format) + "}"
+
+	args := []string{
+		fmt.Sprintf("fontsize=%d", size),
+		"fontcolor=white",
+		"box=1",
+		"boxcolor=black@0.5",
+		"boxborderw=4",
+		"x=" + pos[0],
+		"y=" + pos[1],
+		"text=" + filterQuote(text),
+	}
+	if o.FontFile != "" {
+		args = append(args, "fontfile="+filterQuote(o.FontFile))
+	}
+
+	return "drawtext=" + filterQuote(strings.Join(args, ":"))
+}
+
+// drawtextEscaper escapes literal drawtext text
+var drawtextEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`)
+
+// filterQuote quotes s for one level of FFmpeg's filter graph syntax
+func filterQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,211 @@
+package video
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3d0c/gmf"
+	"github.com/pkg/errors"
+	"github.com/thenrich/go-surv/config"
+)
+
+// QueueStatus reports on a writer's queue
+type QueueStatus struct {
+	Writer   string `json:"writer"`
+	Length   int    `json:"length"`
+	Capacity int    `json:"capacity"`
+	Dropped  int    `json:"dropped"`
+}
+
+// queueItem is a packet or the frames decoded from one, owned by the queue
+type queueItem struct {
+	pkt      *gmf.Packet
+	frames   []*gmf.Frame
+	keyframe bool
+
+	// time the packet was read from the source
+	read time.Time
+
+	// set instead of data to close the writer, closed once it is closed
+	flushed chan struct{}
+}
+
+func (it *queueItem) free() {
+	if it.pkt != nil {
+		it.pkt.Free()
+	}
+
+	for _, f := range it.frames {
+		f.Free()
+	}
+}
+
+// writerQueue feeds a single writer from its own goroutine so a slow writer
+// doesn't hold up the reader or the other writers
+type writerQueue struct {
+	// stream and writer names used in logs and status
+	stream string
+	writer string
+
+	policy config.DropPolicy
+	items  chan *queueItem
+
+	// packets are cut at whole GOPs when dropping
+	packets bool
+
+	// dropping the rest of a GOP, only touched by the pushing goroutine
+	skipping bool
+
+	write func(it *queueItem) error
+	close func() error
+
+	mu      sync.Mutex
+	dropped int
+}
+
+// push queues an item according to the queue's policy, taking ownership of
+// it
+func (q *writerQueue) push(it *queueItem) {
+	switch q.policy {
+	case config.Block:
+		q.items <- it
+
+	case config.DropNonKeyframes:
+		if q.skipping && !it.keyframe {
+			q.drop(it)
+			return
+		}
+		q.skipping = false
+
+		if it.keyframe {
+			q.items <- it
+			return
+		}
+
+		select {
+		case q.items <- it:
+		default:
+			// later packets of the GOP can't be decoded without this one
+			q.skipping = q.packets
+			q.drop(it)
+		}
+
+	default:
+		if q.skipping && !it.keyframe {
+			q.drop(it)
+			return
+		}
+		q.skipping = false
+
+		for {
+			select {
+			case q.items <- it:
+				return
+			default:
+			}
+
+			select {
+			case old := <-q.items:
+				// the evicted packet may be a reference of the rest of
+				// the GOP, unless it is one
+				q.skipping = q.packets && !it.keyframe
+				q.drop(old)
+			default:
+			}
+		}
+	}
+}
+
+// drop frees an item that won't be written
+func (q *writerQueue) drop(it *queueItem) {
+	it.free()
+
+	q.mu.Lock()
+	q.dropped++
+	q.mu.Unlock()
+}
+
+// flush waits for the writer to write everything queued and closes it
+func (q *writerQueue) flush() {
+	flushed := make(chan struct{})
+	q.items <- &queueItem{flushed: flushed}
+	<-flushed
+
+	q.skipping = false
+}
+
+// run writes queued items until the stream goes away
+func (q *writerQueue) run() {
+	for it := range q.items {
+		if it.flushed != nil {
+			if err := q.close(); err != nil {
+				log.Println(errors.Wrapf(err, "error closing %s for %s", q.writer, q.stream))
+			}
+			close(it.flushed)
+			continue
+		}
+
+		if err := q.write(it); err != nil {
+			log.Println(errors.Wrapf(err, "error writing to %s for %s", q.writer, q.stream))
+		}
+		it.free()
+	}
+}
+
+// Status returns the queue's length and dropped item count
+func (q *writerQueue) Status() QueueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return QueueStatus{
+		Writer:   q.writer,
+		Length:   len(q.items),
+		Capacity: cap(q.items),
+		Dropped:  q.dropped,
+	}
+}
+
+// writerName names a writer after its type, e.g. video.LocalWriter, unless
+// it names itself
+func writerName(w interface{}) string {
+	if s, ok := w.(fmt.Stringer); ok {
+		return s.String()
+	}
+
+	return strings.TrimPrefix(fmt.Sprintf("%T", w), "*")
+}
+
+// newPacketQueue creates a queue feeding a packet writer
+func newPacketQueue(stream string, w PacketWriter, size int, policy config.DropPolicy) *writerQueue {
+	return &writerQueue{
+		stream:  stream,
+		writer:  writerName(w),
+		policy:  policy,
+		items:   make(chan *queueItem, size),
+		packets: true,
+		write: func(it *queueItem) error {
+			return w.WritePacket(it.pkt)
+		},
+		close: w.Close,
+	}
+}
+
+// newFrameQueue creates a queue feeding a frame writer
+func newFrameQueue(stream string, w Writer, size int, policy config.DropPolicy) *writerQueue {
+	return &writerQueue{
+		stream: stream,
+		writer: writerName(w),
+		policy: policy,
+		items:  make(chan *queueItem, size),
+		write: func(it *queueItem) error {
+			if tw, ok := w.(timedWriter); ok {
+				return tw.WriteTimed(it.frames, it.read)
+			}
+			return w.Write(it.frames)
+		},
+		close: w.Close,
+	}
+}
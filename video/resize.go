@@ -0,0 +1,221 @@
+package video
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/3d0c/gmf"
+	"github.com/pkg/errors"
+	"github.com/thenrich/go-surv/config"
+)
+
+// maxVariants bounds the resized variants cached per snapshot
+const maxVariants = 8
+
+// stillReadSize is the chunk size stills are fed to FFmpeg in, well below
+// the AVIO buffer size as gmf copies chunks without checking the room left
+const stillReadSize = 4096
+
+// avioMu serializes reading stills through AVIO contexts. gmf keeps the
+// handlers of every AVIO context in a global map without locking it.
+var avioMu sync.Mutex
+
+// variant is a resized snapshot, set once done is closed
+type variant struct {
+	done chan struct{}
+	s    *Snapshot
+	err  error
+}
+
+// Resize returns the snapshot scaled down to fit o's maximum size and
+// encoded in o's format, or the snapshot's format if o has none. Variants
+// are cached on the snapshot, so concurrent requests for the same variant
+// only scale it once.
+func (s *Snapshot) Resize(o StillOptions) (*Snapshot, error) {
+	if o.Format == "" {
+		o.Format, _ = stillFormat(s.ContentType)
+	}
+
+	s.mu.Lock()
+	if v, ok := s.variants[o]; ok {
+		s.mu.Unlock()
+
+		<-v.done
+		return v.s, v.err
+	}
+
+	v := &variant{done: make(chan struct{})}
+	if s.variants == nil {
+		s.variants = make(map[StillOptions]*variant)
+	}
+	cached := len(s.variants) < maxVariants
+	if cached {
+		s.variants[o] = v
+	}
+	s.mu.Unlock()
+
+	v.s, v.err = resizeSnapshot(s, o)
+	close(v.done)
+
+	if v.err != nil && cached {
+		// the next request tries again
+		s.mu.Lock()
+		delete(s.variants, o)
+		s.mu.Unlock()
+	}
+
+	return v.s, v.err
+}
+
+// resizeSnapshot decodes the snapshot's image, scales it and encodes it again
+func resizeSnapshot(s *Snapshot, o StillOptions) (*Snapshot, error) {
+	format, ok := stillFormat(s.ContentType)
+	if !ok {
+		return nil, errors.Errorf("unknown still type %s", s.ContentType)
+	}
+
+	frame, err := readStill(s.Data, format)
+	if err != nil {
+		return nil, err
+	}
+	defer frame.Free()
+
+	width, height := fitSize(frame.Width(), frame.Height(), o.MaxWidth, o.MaxHeight)
+
+	enc, err := newStillEncoder(o, width, height, gmf.AVR{Num: 1, Den: 1}.AVRational())
+	if err != nil {
+		return nil, err
+	}
+	defer gmf.Release(enc)
+
+	swsCtx, err := gmf.NewSwsCtx(
+		frame.Width(),
+		frame.Height(),
+		int32(frame.Format()),
+		width,
+		height,
+		enc.PixFmt(),
+		gmf.SWS_BICUBIC)
+	if err != nil {
+		return nil, errors.Wrap(err, "error create sws ctx")
+	}
+	defer swsCtx.Free()
+
+	packets, err := scaleAndEncode(enc, swsCtx, o, frame)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(packets) == 0 {
+		return nil, errors.New("no packets encoded")
+	}
+
+	v := &Snapshot{
+		Data:        packets[0].Data(),
+		ContentType: o.ContentType(),
+		Time:        s.Time,
+		Width:       width,
+		Height:      height,
+	}
+
+	for _, p := range packets {
+		p.Free()
+	}
+
+	return v, nil
+}
+
+// readStill decodes an image encoded in format. Only one still is read at
+// a time, see avioMu.
+func readStill(data []byte, format config.StillFormat) (*gmf.Frame, error) {
+	avioMu.Lock()
+	defer avioMu.Unlock()
+
+	ctx := gmf.NewCtx()
+
+	r := bytes.NewReader(data)
+	buf := make([]byte, stillReadSize)
+	avio, err := gmf.NewAVIOContext(ctx, &gmf.AVIOHandlers{ReadPacket: func() ([]byte, int) {
+		n, _ := r.Read(buf)
+		if n == 0 {
+			return nil, gmf.AVERROR_EOF
+		}
+		return buf, n
+	}})
+	if err != nil {
+		ctx.Free()
+		return nil, errors.Wrap(err, "error creating IO context")
+	}
+
+	// the input has to be closed before its IO context goes away
+	defer func() {
+		ctx.Free()
+		avio.Free()
+	}()
+
+	ctx.SetPb(avio)
+	if err := ctx.SetInputFormat(stillEncoders[format].demuxer); err != nil {
+		return nil, errors.Wrap(err, "error setting input format")
+	}
+
+	if err := ctx.OpenInput(""); err != nil {
+		return nil, errors.Wrap(err, "error opening still")
+	}
+
+	ist, err := ctx.GetBestStream(gmf.AVMEDIA_TYPE_VIDEO)
+	if err != nil {
+		return nil, errors.Wrap(err, "error finding image stream")
+	}
+	defer ist.Free()
+
+	return decodeStill(ctx, ist)
+}
+
+// decodeStill decodes the single image of a still input
+func decodeStill(ctx *gmf.FmtCtx, ist *gmf.Stream) (*gmf.Frame, error) {
+	par := ist.GetCodecPar()
+
+	codec, err := gmf.FindDecoder(par.GetCodecId())
+	if err != nil {
+		return nil, errors.Wrap(err, "error finding image decoder")
+	}
+
+	dec := gmf.NewCodecCtx(codec)
+	defer gmf.Release(dec)
+
+	if err := par.ToContext(dec); err != nil {
+		return nil, errors.Wrap(err, "error copying image codec parameters")
+	}
+
+	if err := dec.Open(nil); err != nil {
+		return nil, errors.Wrap(err, "error opening image decoder")
+	}
+
+	pkt, err := ctx.GetNextPacket()
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading still")
+	}
+	defer pkt.Free()
+
+	frames, err := dec.Decode(pkt)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding still")
+	}
+
+	if len(frames) == 0 {
+		// drain the decoder
+		if frames, err = dec.Decode(nil); err != nil {
+			return nil, errors.Wrap(err, "error decoding still")
+		}
+	}
+
+	if len(frames) == 0 {
+		return nil, errors.New("no frame decoded")
+	}
+
+	for _, f := range frames[1:] {
+		f.Free()
+	}
+
+	return frames[0], nil
+}
@@ -0,0 +1,125 @@
+package video
+
+import (
+	"sync"
+	"time"
+
+	"github.com/3d0c/gmf"
+)
+
+// ringMaxGOP bounds how far past its duration a ring may grow while waiting
+// for the next keyframe
+const ringMaxGOP = time.Minute
+
+type ringEntry struct {
+	pkt *gmf.Packet
+	at  time.Time
+}
+
+// PacketRing keeps the most recent encoded packets of a stream in memory so
+// writers that start on an event can include the footage leading up to it.
+// The ring always begins at a keyframe and holds at least its duration of
+// packets once enough have been read.
+type PacketRing struct {
+	mu sync.Mutex
+
+	duration time.Duration
+	entries  []ringEntry
+
+	// index of the video stream, GOPs are only cut at its keyframes
+	video int
+}
+
+// SetVideoStream sets the index of the source's video stream. Packets of
+// other streams, e.g. audio, are buffered but never start a GOP.
+func (r *PacketRing) SetVideoStream(index int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.video = index
+}
+
+// keyframe returns true if pkt is a video keyframe
+func (r *PacketRing) keyframe(pkt *gmf.Packet) bool {
+	return pkt.StreamIndex() == r.video && pkt.Flags()&PktFlagKey != 0
+}
+
+// Duration returns the amount of pre-roll the ring keeps
+func (r *PacketRing) Duration() time.Duration {
+	return r.duration
+}
+
+// Push adds a copy of pkt to the ring and drops whole GOPs from the front
+// that are no longer needed to cover the ring's duration.
+func (r *PacketRing) Push(pkt *gmf.Packet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.entries) == 0 && !r.keyframe(pkt) {
+		return
+	}
+
+	now := time.Now()
+	r.entries = append(r.entries, ringEntry{pkt: pkt.Clone(), at: now})
+
+	// find the newest keyframe that still leaves a full duration behind
+	// the current packet
+	cut := 0
+	for i := 1; i < len(r.entries); i++ {
+		if now.Sub(r.entries[i].at) < r.duration {
+			break
+		}
+		if r.keyframe(r.entries[i].pkt) {
+			cut = i
+		}
+	}
+
+	// no keyframe for far too long, start over at the next one
+	if cut == 0 && now.Sub(r.entries[0].at) > r.duration+ringMaxGOP {
+		cut = len(r.entries)
+	}
+
+	r.drop(cut)
+}
+
+// drop frees the first n entries
+func (r *PacketRing) drop(n int) {
+	if n == 0 {
+		return
+	}
+
+	for i := 0; i < n; i++ {
+		r.entries[i].pkt.Free()
+	}
+
+	remaining := make([]ringEntry, len(r.entries)-n)
+	copy(remaining, r.entries[n:])
+	r.entries = remaining
+}
+
+// Packets returns copies of the buffered packets, oldest first. Callers own
+// the returned packets and must free them.
+func (r *PacketRing) Packets() []*gmf.Packet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	packets := make([]*gmf.Packet, 0, len(r.entries))
+	for _, e := range r.entries {
+		packets = append(packets, e.pkt.Clone())
+	}
+
+	return packets
+}
+
+// Reset frees all buffered packets
+func (r *PacketRing) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.drop(len(r.entries))
+}
+
+// NewPacketRing creates a ring holding the given duration of packets
+func NewPacketRing(duration time.Duration) *PacketRing {
+	return &PacketRing{duration: duration}
+}
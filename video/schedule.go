@@ -0,0 +1,61 @@
+package video
+
+import (
+	"log"
+	"time"
+
+	"github.com/3d0c/gmf"
+)
+
+// Schedule defines the interface for deciding when recording is active
+type Schedule interface {
+	Active(t time.Time) bool
+}
+
+// ScheduledWriter passes packets to a recorder only while its schedule is
+// active. The recorder's segment is finalized whenever a window ends.
+type ScheduledWriter struct {
+	PacketWriter
+
+	name     string
+	schedule Schedule
+
+	// whether the schedule was active for the previous packet
+	active bool
+}
+
+// WritePacket drops packets outside the schedule
+func (sw *ScheduledWriter) WritePacket(pkt *gmf.Packet) error {
+	active := sw.schedule.Active(time.Now())
+
+	if active != sw.active {
+		sw.active = active
+		if active {
+			log.Printf("Schedule window started for %s, recording\n", sw.name)
+		} else {
+			log.Printf("Schedule window ended for %s, pausing recording\n", sw.name)
+
+			// finalizes the window's segment
+			return sw.PacketWriter.Close()
+		}
+	}
+
+	if !active {
+		return nil
+	}
+
+	return sw.PacketWriter.WritePacket(pkt)
+}
+
+// SetPreRoll passes the pre-roll ring on to recorders that use one
+func (sw *ScheduledWriter) SetPreRoll(ring *PacketRing) {
+	if w, ok := sw.PacketWriter.(PreRollWriter); ok {
+		w.SetPreRoll(ring)
+	}
+}
+
+// NewScheduledWriter wraps the recorder of camera name so it only records
+// while schedule is active
+func NewScheduledWriter(name string, w PacketWriter, schedule Schedule) *ScheduledWriter {
+	return &ScheduledWriter{PacketWriter: w, name: name, schedule: schedule}
+}
@@ -0,0 +1,153 @@
+package video
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// timestamp embedded in segment file names. Parsing also accepts the
+	// milliseconds of segmentNameFormat.
+	segmentTimeFormat = "2006-01-02-15-04-05"
+
+	// timestamp recorded segments are named with, so a segment reopened
+	// within the same second doesn't replace the previous one
+	segmentNameFormat = segmentTimeFormat + ".000"
+
+	segmentExt = ".mp4"
+)
+
+// SegmentCatalog defines the interface for keeping track of segments as
+// they are recorded and archived
+type SegmentCatalog interface {
+	Recorded(seg *Segment) error
+	Uploaded(seg *Segment, key string) error
+}
+
+// Segment describes a finalized recording on local disk
+type Segment struct {
+	// Camera that recorded the segment
+	Camera string
+
+	// Path to the local file
+	Path string
+
+	// Wall-clock time the segment started
+	Start time.Time
+
+	// Wall-clock time the segment ended, zero if unknown
+	End time.Time
+
+	// Size of the file in bytes
+	Size int64
+
+	// Name of the video codec
+	Codec string
+
+	// Hex encoded SHA-256 of the file, empty if unknown
+	Checksum string
+}
+
+// ID returns the identifier of the segment, unique across cameras
+func (seg *Segment) ID() string {
+	return SegmentID(seg.Path)
+}
+
+// Key returns the deterministic object key used when archiving the segment,
+// e.g. front_door/2018/06/01/front_door-2018-06-01-12-00-00.000.mp4
+func (seg *Segment) Key() string {
+	return fmt.Sprintf("%s/%s/%s", seg.Camera, seg.Start.Format("2006/01/02"), filepath.Base(seg.Path))
+}
+
+// Duration returns the length of the segment, zero if unknown
+func (seg *Segment) Duration() time.Duration {
+	if seg.End.IsZero() {
+		return 0
+	}
+
+	return seg.End.Sub(seg.Start)
+}
+
+// Stat fills in the size and checksum of the segment from its file
+func (seg *Segment) Stat() error {
+	f, err := os.Open(seg.Path)
+	if err != nil {
+		return errors.Wrapf(err, "error opening %s", seg.Path)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return errors.Wrapf(err, "error reading %s", seg.Path)
+	}
+
+	seg.Size = n
+	seg.Checksum = hex.EncodeToString(h.Sum(nil))
+
+	return nil
+}
+
+// SegmentID returns the identifier of the segment stored in filename, which
+// may be a local path or an object key
+func SegmentID(filename string) string {
+	return strings.TrimSuffix(filepath.Base(filename), segmentExt)
+}
+
+// SegmentDir returns the directory segments for a camera are written to
+// under the storage path.
+func SegmentDir(storagePath string, name string) string {
+	return filepath.Join(storagePath, name)
+}
+
+// ParseSegmentTime returns the start time encoded in a segment file name
+func ParseSegmentTime(name string, filename string) (time.Time, error) {
+	base := filepath.Base(filename)
+	if !strings.HasPrefix(base, name+"-") || !strings.HasSuffix(base, segmentExt) {
+		return time.Time{}, errors.Errorf("%s is not a segment of %s", base, name)
+	}
+
+	stamp := strings.TrimSuffix(strings.TrimPrefix(base, name+"-"), segmentExt)
+	start, err := time.Parse(segmentTimeFormat, stamp)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "error parsing time from %s", base)
+	}
+
+	return start, nil
+}
+
+// ListSegments returns the segments for a camera found in dir, oldest first
+func ListSegments(dir string, name string) ([]*Segment, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, name+"-*"+segmentExt))
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing segments")
+	}
+
+	sort.Strings(matches)
+
+	var segments []*Segment
+	for _, m := range matches {
+		start, err := ParseSegmentTime(name, m)
+		if err != nil {
+			continue
+		}
+
+		fi, err := os.Stat(m)
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, &Segment{Camera: name, Path: m, Start: start, Size: fi.Size()})
+	}
+
+	return segments, nil
+}
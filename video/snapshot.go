@@ -0,0 +1,108 @@
+package video
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultSnapshotHistory is the number of stills kept per camera
+const DefaultSnapshotHistory = 60
+
+// Snapshot is a still image captured from a camera
+type Snapshot struct {
+	// Encoded image
+	Data        []byte
+	ContentType string
+
+	// Time the still was captured
+	Time time.Time
+
+	Width  int
+	Height int
+
+	// resized variants by their options
+	mu       sync.Mutex
+	variants map[StillOptions]*variant
+}
+
+// ETag returns a quoted entity tag identifying the snapshot
+func (s *Snapshot) ETag() string {
+	return fmt.Sprintf(`"%x-%x"`, s.Time.UnixNano(), len(s.Data))
+}
+
+// SnapshotStore keeps the most recent stills of a camera. It is safe for
+// concurrent use.
+type SnapshotStore struct {
+	mu sync.RWMutex
+
+	// maximum number of snapshots kept
+	size int
+
+	// oldest first
+	snapshots []*Snapshot
+}
+
+// Add stores a snapshot, dropping the oldest one once the store is full.
+// Snapshots are expected in capture order.
+func (ss *SnapshotStore) Add(s *Snapshot) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if len(ss.snapshots) >= ss.size {
+		n := len(ss.snapshots) - ss.size + 1
+		remaining := make([]*Snapshot, len(ss.snapshots)-n, ss.size)
+		copy(remaining, ss.snapshots[n:])
+		ss.snapshots = remaining
+	}
+
+	ss.snapshots = append(ss.snapshots, s)
+}
+
+// Latest returns the most recent snapshot, or nil if there is none
+func (ss *SnapshotStore) Latest() *Snapshot {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+
+	if len(ss.snapshots) == 0 {
+		return nil
+	}
+
+	return ss.snapshots[len(ss.snapshots)-1]
+}
+
+// Nearest returns the snapshot captured closest to t, or nil if there is
+// none
+func (ss *SnapshotStore) Nearest(t time.Time) *Snapshot {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+
+	if len(ss.snapshots) == 0 {
+		return nil
+	}
+
+	// first snapshot not before t
+	i := sort.Search(len(ss.snapshots), func(i int) bool {
+		return !ss.snapshots[i].Time.Before(t)
+	})
+
+	if i == len(ss.snapshots) {
+		return ss.snapshots[i-1]
+	}
+
+	if i > 0 && t.Sub(ss.snapshots[i-1].Time) < ss.snapshots[i].Time.Sub(t) {
+		return ss.snapshots[i-1]
+	}
+
+	return ss.snapshots[i]
+}
+
+// NewSnapshotStore creates a store keeping the given number of snapshots
+func NewSnapshotStore(size int) *SnapshotStore {
+	if size < 1 {
+		size = 1
+	}
+
+	return &SnapshotStore{size: size}
+}
@@ -0,0 +1,150 @@
+package video
+
+import (
+	"github.com/3d0c/gmf"
+	"github.com/pkg/errors"
+	"github.com/thenrich/go-surv/config"
+)
+
+// stillEncoder describes how stills of a format are encoded
+type stillEncoder struct {
+	encoder     string
+	pixFmt      int32
+	contentType string
+
+	// FFmpeg input format reading the stills back
+	demuxer string
+}
+
+var stillEncoders = map[config.StillFormat]stillEncoder{
+	config.StillJPEG: {"mjpeg", gmf.AV_PIX_FMT_YUVJ420P, "image/jpeg", "jpeg_pipe"},
+	config.StillPNG:  {"png", gmf.AV_PIX_FMT_RGB24, "image/png", "png_pipe"},
+	config.StillWebP: {"libwebp", gmf.AV_PIX_FMT_YUV420P, "image/webp", "webp_pipe"},
+}
+
+// stillFormat returns the format of stills of the given MIME type
+func stillFormat(contentType string) (config.StillFormat, bool) {
+	for f, enc := range stillEncoders {
+		if enc.contentType == contentType {
+			return f, true
+		}
+	}
+
+	return "", false
+}
+
+// StillOptions configures the stills of a camera
+type StillOptions struct {
+	Format config.StillFormat
+
+	// 1-100, ignored for PNG
+	Quality int
+
+	// stills are scaled down to fit, zero leaves a dimension unbounded
+	MaxWidth  int
+	MaxHeight int
+}
+
+// ContentType returns the MIME type of stills in the configured format
+func (o StillOptions) ContentType() string {
+	return stillEncoders[o.Format].contentType
+}
+
+// newStillEncoder opens an encoder for width x height stills
+func newStillEncoder(o StillOptions, width int, height int, tb gmf.AVRational) (*gmf.CodecCtx, error) {
+	enc, ok := stillEncoders[o.Format]
+	if !ok {
+		return nil, errors.Errorf("unknown still format %s", o.Format)
+	}
+
+	codec, err := gmf.FindEncoder(enc.encoder)
+	if err != nil {
+		return nil, errors.Wrap(err, "error finding encoder")
+	}
+
+	cc := gmf.NewCodecCtx(codec)
+	cc.SetTimeBase(tb.AVR())
+	cc.SetPixFmt(enc.pixFmt).SetWidth(width).SetHeight(height)
+
+	if codec.IsExperimental() {
+		cc.SetStrictCompliance(gmf.FF_COMPLIANCE_EXPERIMENTAL)
+	}
+
+	switch o.Format {
+	case config.StillJPEG:
+		cc.SetFlag(int(gmf.AV_CODEC_FLAG_QSCALE))
+		cc.SetGlobalQuality(jpegQScale(o.Quality) * gmf.FF_QP2LAMBDA)
+	case config.StillWebP:
+		cc.SetOptions([]gmf.Option{{Key: "quality", Val: float64(o.Quality)}})
+	}
+
+	if err := cc.Open(nil); err != nil {
+		gmf.Release(cc)
+		return nil, errors.Wrap(err, "error opening codec")
+	}
+
+	return cc, nil
+}
+
+// scaleAndEncode scales frame to the encoder's size and pixel format with
+// swsCtx and encodes it
+func scaleAndEncode(enc *gmf.CodecCtx, swsCtx *gmf.SwsCtx, o StillOptions, frame *gmf.Frame) ([]*gmf.Packet, error) {
+	scaled := gmf.NewFrame().SetWidth(enc.Width()).SetHeight(enc.Height()).SetFormat(enc.PixFmt())
+	if err := scaled.ImgAlloc(); err != nil {
+		scaled.Free()
+		return nil, errors.Wrap(err, "error allocating frame")
+	}
+	swsCtx.Scale(frame, scaled)
+
+	if o.Format == config.StillJPEG {
+		// the MJPEG encoder takes the quantizer from the frame
+		scaled.SetQuality(jpegQScale(o.Quality) * gmf.FF_QP2LAMBDA)
+	}
+
+	// Encode frees scaled
+	packets, err := enc.Encode([]*gmf.Frame{scaled}, -1)
+	if err != nil {
+		scaled.Free()
+		return nil, errors.Wrap(err, "error encoding")
+	}
+
+	return packets, nil
+}
+
+// jpegQScale maps a quality of 1-100 to the MJPEG quantizer scale, 31 being
+// the worst and 2 the best
+func jpegQScale(quality int) int {
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+
+	return 31 - (quality-1)*29/99
+}
+
+// fitSize scales width x height down to fit maxWidth x maxHeight, keeping
+// the aspect ratio. Dimensions are kept even for chroma subsampled formats.
+func fitSize(width int, height int, maxWidth int, maxHeight int) (int, int) {
+	w, h := width, height
+
+	if maxWidth > 0 && w > maxWidth {
+		h = h * maxWidth / w
+		w = maxWidth
+	}
+
+	if maxHeight > 0 && h > maxHeight {
+		w = w * maxHeight / h
+		h = maxHeight
+	}
+
+	w, h = w&^1, h&^1
+	if w < 2 {
+		w = 2
+	}
+	if h < 2 {
+		h = 2
+	}
+
+	return w, h
+}
@@ -4,17 +4,74 @@ import (
 	"github.com/pkg/errors"
 	"io"
 	"log"
+	"math/rand"
+	"sync"
+	"time"
 
 	"github.com/3d0c/gmf"
+	"github.com/thenrich/go-surv/config"
 )
 
-func init() {
+const (
+	// initial delay before reopening a failed source
+	reconnectMin = time.Second
+
+	// maximum delay between attempts to reopen a source
+	reconnectMax = time.Minute
+)
 
+func init() {
+	// reconnection jitter
+	rand.Seed(time.Now().UnixNano())
 }
 
 // Still defines an object for holding bytes for still images
 type Still struct {
-	imgData []byte
+	imgData     []byte
+	contentType string
+
+	// capture time and dimensions
+	time          time.Time
+	width, height int
+}
+
+// packet pairs an encoded packet read from the source with the frames
+// decoded from it.
+type packet struct {
+	pkt    *gmf.Packet
+	frames []*gmf.Frame
+
+	// whether pkt is a video keyframe
+	keyframe bool
+
+	// time pkt was read from the source
+	read time.Time
+
+	// set instead of pkt when the source was lost, closed once the
+	// writers have finalized their output
+	flushed chan struct{}
+
+	// generation of the reader that sent the packet, or the stream's
+	// generation at the time of a flush
+	gen int
+}
+
+// timedWriter is implemented by frame writers that need the time frames
+// were read from the source rather than the time they are written, which
+// lags behind by as much as a queue
+type timedWriter interface {
+	WriteTimed(frames []*gmf.Frame, read time.Time) error
+}
+
+// timeBaseSetter is implemented by frame writers that need the source time
+// base
+type timeBaseSetter interface {
+	SetTimeBase(tb gmf.AVRational)
+}
+
+// streamSetter is implemented by frame writers that need the source stream
+type streamSetter interface {
+	SetStream(st *gmf.Stream)
 }
 
 // Stream supports reading from a Camera and writing to one
@@ -24,15 +81,67 @@ type Stream struct {
 	// Camera for this stream
 	cam *Camera
 
-	// video source
+	// source URL, the camera's main stream or its substream
+	url string
+
+	// name used in logs
+	name string
+
+	// guards the fields below
+	mu sync.Mutex
+
+	// video source, owned by the reader that opened it
 	demuxer *demuxer
 
+	// incremented whenever the reader is abandoned, e.g. after a stall.
+	// Readers of older generations close their source and exit as soon
+	// as they notice.
+	generation int
+
+	// whether the source is open and packets are expected
+	connected bool
+
+	// time the last packet was read
+	lastPacket time.Time
+
+	// time the reader started waiting for the next packet, the stall
+	// timeout is measured from it. Zero while the reader is busy, e.g.
+	// handing a packet to slow writers.
+	waitingSince time.Time
+
+	// health of the stream, see Status
+	state          State
+	lastError      string
+	lastErrorTime  time.Time
+	reconnects     int
+	connectedSince time.Time
+
+	// consecutive failed connection attempts
+	attempts int
+
+	// whether the writers goroutine is running
+	started bool
+
+	// closed once the stream has been cleaned up, stopping its goroutines
+	done    chan struct{}
+	stopped bool
+
 	// channel of packet data
-	data chan []*gmf.Frame
+	data chan *packet
 
 	// outputs
 	writers []Writer
 
+	// outputs consuming encoded packets
+	packetWriters []PacketWriter
+
+	// queues feeding each writer, created on Start
+	frameQueues  []*writerQueue
+	packetQueues []*writerQueue
+
+	// recent packets kept for writers that need pre-roll
+	ring *PacketRing
+
 	// streams
 	//streams []av.CodecData
 
@@ -40,114 +149,573 @@ type Stream struct {
 	stills chan *Still
 }
 
-// NewStream creates a new stream for a Camera
-func NewStream(cam *Camera) *Stream {
+// NewStream creates a new stream reading the given source of a Camera
+func NewStream(cam *Camera, url string) *Stream {
+	name := cam.Name
+	if url != cam.SourceURL {
+		name += " substream"
+	}
+
 	return &Stream{
 		cam: cam,
+		url: url,
+		name: name,
 		stills: make(chan *Still, 100),
-		data: make(chan []*gmf.Frame),
+		data: make(chan *packet),
+		done: make(chan struct{}),
+		state: StateConnecting,
 	}
 }
 
-// AddWriter adds a new writer to the stream and opens it
+// AddWriter adds a frame writer to the stream. Writers are given the
+// source's codec context every time the source is opened.
 func (s *Stream) AddWriter(w Writer) {
-	//if err := w.Open(s.streams); err != nil {
-	//	log.Println(errors.Wrap(err, "error opening still writer"))
-	//}
-
 	s.writers = append(s.writers, w)
 }
 
+// AddPacketWriter adds a packet writer to the stream. Writers are opened
+// against the source's video and audio streams every time the source is
+// opened.
+func (s *Stream) AddPacketWriter(w PacketWriter) {
+	// only streams feeding recorders need pre-roll
+	if s.ring == nil && s.cam.PreRoll > 0 {
+		s.ring = NewPacketRing(s.cam.PreRoll)
+	}
+
+	if pw, ok := w.(PreRollWriter); ok && s.ring != nil {
+		pw.SetPreRoll(s.ring)
+	}
+
+	s.packetWriters = append(s.packetWriters, w)
+}
+
+// attach points every writer at a newly opened source
+func (s *Stream) attach(d *demuxer) {
+	src := d.srcVideo
+
+	for _, w := range s.writers {
+		if tw, ok := w.(timeBaseSetter); ok {
+			tw.SetTimeBase(src.TimeBase())
+		}
+
+		if sw, ok := w.(streamSetter); ok {
+			sw.SetStream(src)
+		}
+
+		if err := w.SetCodecContext(d.decoder()); err != nil {
+			log.Println(errors.Wrapf(err, "error setting codec context for %s", s.name))
+		}
+	}
+
+	if s.ring != nil {
+		s.ring.SetVideoStream(src.Index())
+	}
+
+	for _, w := range s.packetWriters {
+		if err := w.Open(src, d.srcAudio); err != nil {
+			log.Println(errors.Wrapf(err, "error opening packet writer for %s", s.name))
+		}
+	}
+}
+
+// PreRoll returns the ring of recently read packets, or nil if the camera
+// has no pre-roll configured.
+func (s *Stream) PreRoll() *PacketRing {
+	return s.ring
+}
+
 // Stills returns the channel used for communicating still images
 func (s *Stream) Stills() chan *Still {
 	return s.stills
 }
 
+// Stalled returns true if the source stopped delivering packets and is
+// being restarted
+func (s *Stream) Stalled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state == StateStalled
+}
+
 // openStream opens the source stream
-func (s *Stream) openStream() error {
-	// Open video file
+func (s *Stream) openStream() (*demuxer, error) {
+	// audio is only read for recorders
+	audio := s.cam.Audio && len(s.packetWriters) > 0
 
-	s.demuxer = NewDemuxer(s.cam.SourceURL)
+	demuxer := NewDemuxer(s.url, s.cam.ReadTimeout, audio)
+	demuxer.options = s.cam.InputOptions
+	demuxer.lowDelay = s.cam.LowDelay
 
-	if err := s.demuxer.open(); err != nil {
-		return errors.Wrap(err, "error opening demuxer")
+	if err := demuxer.open(); err != nil {
+		return nil, errors.Wrap(err, "error opening demuxer")
 	}
 
-	return nil
+	return demuxer, nil
 }
 
-// Open camera stream and return the available stream data.
-func (s *Stream) Open() error {
-	if err := s.openStream(); err != nil {
-		return errors.Wrap(err, "error opening stream")
+// connect opens the source, backing off exponentially with jitter between
+// failed attempts, and attaches the writers to it. It returns nil if the
+// reader of generation gen has been abandoned in the meantime.
+func (s *Stream) connect(gen int) *demuxer {
+	delay := reconnectMin
+	for {
+		d, err := s.openStream()
+		if err == nil {
+			s.mu.Lock()
+			if gen != s.generation {
+				s.mu.Unlock()
+				d.Close()
+				return nil
+			}
+
+			s.demuxer = d
+			s.connected = true
+			s.lastPacket = time.Now()
+			s.waitingSince = s.lastPacket
+			s.state = StateStreaming
+			s.connectedSince = time.Now()
+			s.attempts = 0
+			s.attach(d)
+			s.mu.Unlock()
+
+			log.Printf("Connected to %s\n", s.name)
+			return d
+		}
+
+		s.mu.Lock()
+		if gen == s.generation {
+			s.attempts++
+
+			state := StateReconnecting
+			if s.connectedSince.IsZero() {
+				state = StateConnecting
+			}
+			if s.attempts >= failedAttempts {
+				state = StateFailed
+			}
+			s.fail(state, err)
+		}
+		s.mu.Unlock()
+
+		// sleep between half and all of the delay so cameras that dropped
+		// together don't retry in lockstep
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+		log.Println(errors.Wrapf(err, "error connecting to %s, retrying in %s", s.name, wait))
+		time.Sleep(wait)
+
+		if s.abandoned(gen) {
+			return nil
+		}
+
+		delay *= 2
+		if delay > reconnectMax {
+			delay = reconnectMax
+		}
+	}
+}
+
+// abandoned returns true if the reader of generation gen should stop
+func (s *Stream) abandoned(gen int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return gen != s.generation
+}
+
+// disconnect finalizes the writers' output and closes a source that failed
+// with err. The next segment starts once the source has been reopened. It
+// returns false if the reader has been abandoned.
+func (s *Stream) disconnect(gen int, d *demuxer, err error) bool {
+	s.mu.Lock()
+	current := gen == s.generation
+	if current {
+		s.connected = false
+		s.demuxer = nil
+		s.reconnects++
+		s.fail(StateReconnecting, err)
+		s.flush()
+	}
+	s.mu.Unlock()
+
+	if err := d.Close(); err != nil {
+		log.Println(err)
 	}
 
-	return nil
+	return current
+}
+
+// send hands a packet to the writers. It returns false without taking
+// ownership of the packet if the reader has been abandoned. The lock isn't
+// held while the writers are busy; packets of a reader abandoned meanwhile
+// are dropped by the writers goroutine.
+func (s *Stream) send(gen int, p *packet) bool {
+	s.mu.Lock()
+	if gen != s.generation {
+		s.mu.Unlock()
+		return false
+	}
+	s.mu.Unlock()
+
+	p.gen = gen
+	select {
+	case s.data <- p:
+	case <-s.done:
+		return false
+	}
+
+	s.mu.Lock()
+	if gen == s.generation {
+		s.waitingSince = time.Now()
+	}
+	s.mu.Unlock()
+
+	return true
+}
+
+// received records that the reader of generation gen got a packet from the
+// source at read. The stall timeout is paused until the packet is handed
+// off.
+func (s *Stream) received(gen int, read time.Time) {
+	s.mu.Lock()
+	if gen == s.generation {
+		s.lastPacket = read
+		s.waitingSince = time.Time{}
+	}
+	s.mu.Unlock()
+}
+
+// flush waits for the writers goroutine to finalize the writers' output.
+// Must be called with mu held. Packets handed over afterwards by readers
+// older than the current generation are dropped.
+func (s *Stream) flush() {
+	if !s.started {
+		s.closeWriters()
+		return
+	}
+
+	flushed := make(chan struct{})
+	s.data <- &packet{flushed: flushed, gen: s.generation}
+	<-flushed
+}
+
+// watch restarts the stream whenever no packet arrives within the camera's
+// stall timeout, e.g. on a half-open connection. The blocked reader is
+// abandoned and closes its source once its read returns.
+func (s *Stream) watch() {
+	timeout := s.cam.StallTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	interval := timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		s.mu.Lock()
+		if s.connected && !s.waitingSince.IsZero() && time.Since(s.waitingSince) > timeout {
+			log.Printf("No packets from %s for %s, restarting stream\n", s.name, timeout)
+
+			s.generation++
+			s.connected = false
+			s.demuxer = nil
+			s.reconnects++
+			s.fail(StateStalled, errors.Errorf("no packets for %s", timeout))
+			s.flush()
+
+			go s.startReader(s.generation)
+		}
+		s.mu.Unlock()
+	}
 }
 
 // Start the stream.
 //
 // Here we start the writers goroutine which starts reading from the
-// data channel and writes the packet to all writers when one is received.
-// Then we start the reader to read the packets from the demuxer buffer.
+// data channel and hands each packet to the queue of every writer, each
+// drained by its own goroutine.
+// Then we start the reader to read the packets from the demuxer buffer,
+// and the watchdog restarting it when the source stalls.
 func (s *Stream) Start() {
+	s.mu.Lock()
+	s.started = true
+	gen := s.generation
+	paused := s.state == StatePaused
+
+	for _, w := range s.packetWriters {
+		q := newPacketQueue(s.name, w, s.cam.QueueSize, s.cam.DropPolicy)
+		s.packetQueues = append(s.packetQueues, q)
+		go q.run()
+	}
+
+	for _, w := range s.writers {
+		q := newFrameQueue(s.name, w, s.cam.QueueSize, s.cam.DropPolicy)
+		s.frameQueues = append(s.frameQueues, q)
+		go q.run()
+	}
+	s.mu.Unlock()
+
 	go s.startWriters()
-	go s.startReader()
+	if !paused {
+		go s.startReader(gen)
+	}
+	go s.watch()
 }
 
 func (s *Stream) startWriters() {
+	// generation of the last flush, packets of older readers are stale
+	var gen int
+
 	for {
 		select {
-		case frames := <-s.data:
-			for _, w := range s.writers {
-				if err := w.Write(frames); err != nil {
-					log.Println(errors.Wrapf(err, "error writing packet to %s", w))
+		case <-s.done:
+			return
+
+		case p := <-s.data:
+			if p.flushed != nil {
+				s.closeWriters()
+				gen = p.gen
+				close(p.flushed)
+				continue
+			}
+
+			if p.gen < gen {
+				for i := range p.frames {
+					p.frames[i].Free()
 				}
+				p.pkt.Free()
+				continue
 			}
 
-			for i := range frames {
-				frames[i].Free()
+			for _, q := range s.packetQueues {
+				q.push(&queueItem{pkt: p.pkt.Clone(), keyframe: p.keyframe})
+			}
+
+			// buffered after queueing so the ring holds only packets
+			// preceding the one writers are handling
+			if s.ring != nil {
+				s.ring.Push(p.pkt)
 			}
 
+			if len(p.frames) > 0 {
+				for _, q := range s.frameQueues {
+					frames := make([]*gmf.Frame, 0, len(p.frames))
+					for _, f := range p.frames {
+						frames = append(frames, f.CloneNewFrame())
+					}
+					q.push(&queueItem{frames: frames, keyframe: p.keyframe, read: p.read})
+				}
+			}
 
+			for i := range p.frames {
+				p.frames[i].Free()
+			}
+			p.pkt.Free()
 		}
 	}
 }
 
-func (s *Stream) startReader() {
+// startReader reads from the source until the reader is abandoned,
+// reconnecting whenever the source fails or ends
+func (s *Stream) startReader(gen int) {
+	var d *demuxer
 	for {
+		if d == nil {
+			if d = s.connect(gen); d == nil {
+				return
+			}
+		}
+
 		// read packets
-		var err error
+		pkt, err := d.ReadPacket()
+		read := time.Now()
+		if err == io.EOF {
+			log.Printf("%s closed the stream, reconnecting", s.name)
+		} else if err != nil {
+			log.Println(errors.Wrapf(err, "error reading from %s, reconnecting", s.name))
+		}
+		if err != nil {
+			if !s.disconnect(gen, d, err) {
+				return
+			}
+			d = nil
+			continue
+		}
+		s.received(gen, read)
+
+		keyframe := pkt.StreamIndex() == d.srcVideo.Index() && pkt.Flags()&PktFlagKey != 0
+
+		// only video is decoded, audio is passed on to packet writers.
+		// Streams without frame writers, e.g. a main stream whose
+		// substream is decoded instead, are never decoded.
 		var frames []*gmf.Frame
-		if frames, err = s.demuxer.ReadFrames(); err != nil {
-			if err == io.EOF {
-				break
+		if len(s.writers) > 0 && pkt.StreamIndex() == d.srcVideo.Index() && s.decodes(d, keyframe) {
+			if frames, err = d.Decode(pkt); err != nil {
+				log.Println(err)
 			}
-			log.Println(errors.Wrap(err, "error reading packet"))
-			break
 		}
 
+		if !s.send(gen, &packet{pkt: pkt, frames: frames, keyframe: keyframe, read: read}) {
+			for i := range frames {
+				frames[i].Free()
+			}
+			pkt.Free()
+			d.Close()
+			return
+		}
+	}
+}
 
-		s.data <- frames
+// decodes returns true if a video packet read from d should be decoded
+// according to the camera's decode mode
+func (s *Stream) decodes(d *demuxer, keyframe bool) bool {
+	if s.cam.Decode != config.DecodeKeyframes {
+		return true
+	}
+
+	if !keyframe {
+		return false
+	}
+
+	now := time.Now()
+	if now.Sub(d.lastDecode) < s.cam.DecodeInterval {
+		return false
+	}
+	d.lastDecode = now
+
+	return true
+}
+
+// closeWriters finalizes the output of every writer, e.g. the segment being
+// recorded, and drops the pre-roll which can't be continued after a gap.
+// Once started, writers are closed by their queues after writing what was
+// queued before.
+func (s *Stream) closeWriters() {
+	if s.started {
+		for _, q := range s.packetQueues {
+			q.flush()
+		}
+
+		for _, q := range s.frameQueues {
+			q.flush()
+		}
+
+		if s.ring != nil {
+			s.ring.Reset()
+		}
+
+		return
+	}
+
+	for id := range s.packetWriters {
+		if err := s.packetWriters[id].Close(); err != nil {
+			log.Println(errors.Wrapf(err, "error closing %s", s.packetWriters[id]))
+		}
+	}
+
+	for id := range s.writers {
+		if err := s.writers[id].Close(); err != nil {
+			log.Println(errors.Wrapf(err, "error closing %s", s.writers[id]))
+		}
+	}
+
+	if s.ring != nil {
+		s.ring.Reset()
+	}
+}
+
+// Pause stops reading from the source and finalizes the writers' output
+// until Resume is called
+func (s *Stream) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped || s.state == StatePaused {
+		return
+	}
+
+	s.generation++
+	s.connected = false
+	s.demuxer = nil
+	s.state = StatePaused
+	s.flush()
+}
 
-		//// Write packet to each writer
-		//for _, w := range s.writers {
-		//	if err := w.Write(pkt); err != nil {
-		//		log.Println(errors.Wrapf(err, "error writing packet to %s", w))
-		//	}
-		//}
+// Resume reopens the source of a paused stream
+func (s *Stream) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped || s.state != StatePaused {
+		return
+	}
+
+	s.state = StateConnecting
+	s.attempts = 0
+	if s.started {
+		go s.startReader(s.generation)
 	}
 }
 
-// Cleanup closes streams and calls the Close method on each writer
+// Restart closes the source, finalizing the writers' output, and opens it
+// again
+func (s *Stream) Restart() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return
+	}
+
+	log.Printf("Restarting %s\n", s.name)
+
+	s.generation++
+	s.connected = false
+	s.demuxer = nil
+	s.state = StateConnecting
+	s.attempts = 0
+	s.flush()
+
+	if s.started {
+		go s.startReader(s.generation)
+	}
+}
+
+// Cleanup stops reading from the source, calls the Close method on each
+// writer and stops the stream's goroutines. The reader closes the source
+// once it notices.
 func (s *Stream) Cleanup() {
-	//for id := range s.writers {
-	//	if err := s.writers[id].Close(); err != nil {
-	//		log.Println(errors.Wrapf(err, "error closing %s", s.writers[id]))
-	//	}
-	//}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if err := s.demuxer.Close(); err != nil {
-		log.Println(err)
+	if s.stopped {
+		return
+	}
+
+	s.generation++
+	s.connected = false
+	s.demuxer = nil
+	s.flush()
+
+	s.stopped = true
+	close(s.done)
+
+	// nothing is queued once the flush is done
+	for _, q := range s.packetQueues {
+		close(q.items)
+	}
+	for _, q := range s.frameQueues {
+		close(q.items)
 	}
 }
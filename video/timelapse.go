@@ -0,0 +1,299 @@
+package video
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/3d0c/gmf"
+	"github.com/pkg/errors"
+)
+
+// TimelapseDir returns the directory timelapses for a camera are written to
+// under the storage path, next to its recorded segments.
+func TimelapseDir(storagePath string, name string) string {
+	return filepath.Join(SegmentDir(storagePath, name), "timelapse")
+}
+
+// TimelapsePath returns the file a timelapse of a camera starting at start
+// is written to
+func TimelapsePath(storagePath string, name string, start time.Time) string {
+	return filepath.Join(TimelapseDir(storagePath, name), fmt.Sprintf("%s-%s%s", name, start.Format(segmentTimeFormat), segmentExt))
+}
+
+// TimelapseEncoder encodes individually sampled frames to an H.264 MP4
+// played back at a fixed frame rate.
+type TimelapseEncoder struct {
+	path      string
+	frameRate int
+
+	outputCtx *gmf.FmtCtx
+	ost       *gmf.Stream
+	encCtx    *gmf.CodecCtx
+	swsCtx    *gmf.SwsCtx
+
+	// source format the scaler was created for
+	srcWidth, srcHeight int
+	srcPixFmt           int32
+
+	// next presentation timestamp, in frames
+	frames int64
+}
+
+// open creates the encoder and output file sized after the source codec
+// context
+func (te *TimelapseEncoder) open(src *gmf.CodecCtx) error {
+	if err := os.MkdirAll(filepath.Dir(te.path), 0755); err != nil {
+		return errors.Wrapf(err, "error creating %s", filepath.Dir(te.path))
+	}
+
+	codec, err := gmf.FindEncoder("libx264")
+	if err != nil {
+		return errors.Wrap(err, "error finding encoder")
+	}
+
+	// fragmented so the file stays playable while it grows
+	outputCtx, err := gmf.NewOutputCtx(te.path, []gmf.Option{
+		{Key: "movflags", Val: "frag_keyframe+empty_moov+default_base_moof"},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error creating %s", te.path)
+	}
+
+	// yuv420p needs even dimensions
+	width, height := src.Width()&^1, src.Height()&^1
+
+	cc := gmf.NewCodecCtx(codec)
+	cc.SetTimeBase(gmf.AVR{Num: 1, Den: te.frameRate})
+	cc.SetPixFmt(gmf.AV_PIX_FMT_YUV420P).SetWidth(width).SetHeight(height)
+	cc.SetGopSize(te.frameRate)
+	cc.SetOptions([]gmf.Option{{Key: "preset", Val: "veryfast"}, {Key: "crf", Val: "23"}})
+	if outputCtx.IsGlobalHeader() {
+		cc.SetFlag(gmf.CODEC_FLAG_GLOBAL_HEADER)
+	}
+
+	if err := cc.Open(nil); err != nil {
+		gmf.Release(cc)
+		outputCtx.Free()
+		return errors.Wrap(err, "error opening codec")
+	}
+
+	ost, err := outputCtx.AddStreamWithCodeCtx(cc)
+	if err != nil {
+		gmf.Release(cc)
+		outputCtx.Free()
+		return errors.Wrap(err, "error creating output stream")
+	}
+	ost.SetTimeBase(gmf.AVR{Num: 1, Den: te.frameRate})
+
+	if err := outputCtx.WriteHeader(); err != nil {
+		gmf.Release(cc)
+		outputCtx.Free()
+		return errors.Wrap(err, "error writing header")
+	}
+
+	te.outputCtx = outputCtx
+	te.ost = ost
+	te.encCtx = cc
+
+	return nil
+}
+
+// scaler returns a scaler from the frames of src to the encoder's format.
+// Sources may change size between frames, e.g. across archived segments.
+func (te *TimelapseEncoder) scaler(src *gmf.CodecCtx) (*gmf.SwsCtx, error) {
+	if te.swsCtx != nil && src.Width() == te.srcWidth && src.Height() == te.srcHeight && src.PixFmt() == te.srcPixFmt {
+		return te.swsCtx, nil
+	}
+
+	if te.swsCtx != nil {
+		te.swsCtx.Free()
+		te.swsCtx = nil
+	}
+
+	swsCtx, err := gmf.NewSwsCtx(
+		src.Width(),
+		src.Height(),
+		src.PixFmt(),
+		te.encCtx.Width(),
+		te.encCtx.Height(),
+		gmf.AV_PIX_FMT_YUV420P,
+		gmf.SWS_BICUBIC)
+	if err != nil {
+		return nil, errors.Wrap(err, "error create sws ctx")
+	}
+
+	te.swsCtx = swsCtx
+	te.srcWidth, te.srcHeight, te.srcPixFmt = src.Width(), src.Height(), src.PixFmt()
+
+	return swsCtx, nil
+}
+
+// WriteFrame appends a frame decoded by src to the timelapse. The frame is
+// not freed.
+func (te *TimelapseEncoder) WriteFrame(frame *gmf.Frame, src *gmf.CodecCtx) error {
+	if te.outputCtx == nil {
+		if err := te.open(src); err != nil {
+			return err
+		}
+	}
+
+	swsCtx, err := te.scaler(src)
+	if err != nil {
+		return err
+	}
+
+	scaled := gmf.NewFrame().SetWidth(te.encCtx.Width()).SetHeight(te.encCtx.Height()).SetFormat(gmf.AV_PIX_FMT_YUV420P)
+	if err := scaled.ImgAlloc(); err != nil {
+		scaled.Free()
+		return errors.Wrap(err, "error allocating frame")
+	}
+	swsCtx.Scale(frame, scaled)
+	scaled.SetPts(te.frames)
+	te.frames++
+
+	// Encode frees scaled
+	packets, err := te.encCtx.Encode([]*gmf.Frame{scaled}, -1)
+	if err != nil {
+		scaled.Free()
+		return errors.Wrap(err, "error encoding")
+	}
+
+	return te.writePackets(packets)
+}
+
+// writePackets muxes encoded packets and frees them
+func (te *TimelapseEncoder) writePackets(packets []*gmf.Packet) error {
+	var err error
+	for _, p := range packets {
+		if err == nil {
+			gmf.RescaleTs(p, te.encCtx.TimeBase(), te.ost.TimeBase())
+			p.SetStreamIndex(te.ost.Index())
+			err = te.outputCtx.WritePacket(p)
+		}
+		p.Free()
+	}
+
+	return errors.Wrap(err, "error writing packet")
+}
+
+// Frames returns the number of frames written
+func (te *TimelapseEncoder) Frames() int64 {
+	return te.frames
+}
+
+// Close flushes the encoder and finalizes the file
+func (te *TimelapseEncoder) Close() error {
+	if te.outputCtx == nil {
+		return nil
+	}
+
+	packets, err := te.encCtx.Encode(nil, 1)
+	if err == nil {
+		err = te.writePackets(packets)
+	}
+
+	te.outputCtx.WriteTrailer()
+	te.outputCtx.Free()
+	gmf.Release(te.encCtx)
+	te.outputCtx = nil
+
+	if te.swsCtx != nil {
+		te.swsCtx.Free()
+		te.swsCtx = nil
+	}
+
+	return errors.Wrap(err, "error flushing encoder")
+}
+
+// NewTimelapseEncoder creates an encoder writing to path at frameRate frames
+// per second. The file is created with the first frame.
+func NewTimelapseEncoder(path string, frameRate int) *TimelapseEncoder {
+	return &TimelapseEncoder{path: path, frameRate: frameRate}
+}
+
+// TimelapseWriter is a frame writer that samples the live stream every
+// interval into a daily timelapse.
+type TimelapseWriter struct {
+	mu sync.Mutex
+
+	name        string
+	storagePath string
+	interval    time.Duration
+	frameRate   int
+
+	codecCtx *gmf.CodecCtx
+
+	enc        *TimelapseEncoder
+	day        time.Time
+	lastSample time.Time
+}
+
+func (tw *TimelapseWriter) SetCodecContext(ctx *gmf.CodecCtx) error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	// the frame size may have changed, start a new file
+	tw.closeEncoder()
+	tw.codecCtx = ctx
+
+	return nil
+}
+
+// Write samples the newest frame once per interval, starting a new file
+// at local midnight
+func (tw *TimelapseWriter) Write(frames []*gmf.Frame) error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	now := time.Now()
+	if len(frames) == 0 || now.Sub(tw.lastSample) < tw.interval {
+		return nil
+	}
+	tw.lastSample = now
+
+	if tw.codecCtx == nil {
+		return errors.New("timelapse writer has no codec context")
+	}
+
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if tw.enc != nil && !day.Equal(tw.day) {
+		tw.closeEncoder()
+	}
+
+	if tw.enc == nil {
+		tw.day = day
+		tw.enc = NewTimelapseEncoder(TimelapsePath(tw.storagePath, tw.name, now.UTC()), tw.frameRate)
+	}
+
+	return tw.enc.WriteFrame(frames[len(frames)-1], tw.codecCtx)
+}
+
+func (tw *TimelapseWriter) closeEncoder() {
+	if tw.enc == nil {
+		return
+	}
+
+	if err := tw.enc.Close(); err != nil {
+		log.Println(errors.Wrapf(err, "error closing timelapse for %s", tw.name))
+	}
+	tw.enc = nil
+}
+
+func (tw *TimelapseWriter) Close() error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	tw.closeEncoder()
+
+	return nil
+}
+
+// NewTimelapseWriter creates a writer sampling a frame every interval into
+// timelapses played back at frameRate, stored under storagePath
+func NewTimelapseWriter(name string, storagePath string, interval time.Duration, frameRate int) *TimelapseWriter {
+	return &TimelapseWriter{name: name, storagePath: storagePath, interval: interval, frameRate: frameRate}
+}
@@ -2,14 +2,48 @@ package video
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/3d0c/gmf"
 	"github.com/pkg/errors"
 	"image"
 	"image/jpeg"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
-// Writer defines the interface for writing video packets
+const (
+	// NoPTS is AV_NOPTS_VALUE; the constant exported by gmf has the wrong
+	// value
+	NoPTS int64 = math.MinInt64
+
+	// PktFlagKey is AV_PKT_FLAG_KEY
+	PktFlagKey = 0x0001
+)
+
+// PacketWriter defines the interface for writers consuming encoded packets.
+// Writers are opened with the source's video stream and its audio stream,
+// which is nil when the source has none or audio is disabled.
+type PacketWriter interface {
+	Open(video *gmf.Stream, audio *gmf.Stream) error
+	WritePacket(pkt *gmf.Packet) error
+	Close() error
+}
+
+// PreRollWriter is implemented by packet writers that include the packets
+// buffered before they started writing, e.g. event recorders. The ring
+// holds the packets read before the one currently being written.
+type PreRollWriter interface {
+	PacketWriter
+	SetPreRoll(ring *PacketRing)
+}
+
+// Writer defines the interface for writers consuming decoded video frames.
+// Sources are only decoded while a stream has at least one.
 type Writer interface {
 	//Open(streams []av.CodecData) error
 	Write(writer []*gmf.Frame) error
@@ -17,177 +51,627 @@ type Writer interface {
 	Close() error
 }
 
-//
-//// CloudWriter defines the interface for writing files to cloud providers
-//type CloudWriter interface {
-//	UploadFile(r io.ReadCloser, key string) error
-//}
-//
-//type CloudStorage struct {
-//	*LocalWriter
-//	writer CloudWriter
-//
-//	nextUploadFile string
-//	nextUploadTime time.Time
-//}
-//
-//func (cs *CloudStorage) Write(pkt av.Packet) error {
-//	if err := cs.LocalWriter.dst.WritePacket(pkt); err != nil {
-//		return errors.Wrap(err, "error writing packet to local writer")
-//	}
-//
-//	if cs.nextRotation.Before(time.Now().UTC()) {
-//		log.Println("Time to rotate")
-//		// Set file to upload
-//		cs.nextUploadFile = cs.outfile
-//		cs.nextUploadTime = cs.now
-//		if err := cs.rotate(); err != nil {
-//			log.Println(errors.Wrap(err, "error rotating"))
-//		}
-//	}
-//
-//	return nil
-//}
-//
-//// Rotate closes the local writer and reopens it at the current time
-//func (cs *CloudStorage) rotate() error {
-//	if err := cs.Close(); err != nil {
-//		return errors.Wrap(err, "rotate: error closing local writer")
-//	}
-//
-//	if err := cs.Open(nil); err != nil {
-//		return errors.Wrap(err, "rotate: error opening new local writer")
-//	}
-//
-//	cs.nextRotation = time.Now().UTC().Add(cs.duration)
-//
-//	return nil
-//}
-//
-//// Close begins uploading completed file to S3
-//func (cs *CloudStorage) Close() error {
-//	if err := cs.LocalWriter.Close(); err != nil {
-//		log.Println(errors.Wrap(err, "error closing file in s3 writer"))
-//	}
-//
-//	if cs.nextUploadFile != "" {
-//		go func() {
-//			f, err := os.Open(cs.nextUploadFile)
-//			if err != nil {
-//				log.Println(err)
-//				return
-//			}
-//			defer f.Close()
-//			key := fmt.Sprintf("%d-%d-%d/%s", cs.nextUploadTime.Year(), cs.nextUploadTime.Month(), cs.nextUploadTime.Day(), strings.Replace(cs.nextUploadFile, "/tmp", "", 1))
-//			err = cs.writer.UploadFile(f, key)
-//			if err != nil {
-//				log.Println(err)
-//			}
-//			// Copy our reference to the filename so we can clear nextUploadFile
-//			deleteFile := cs.nextUploadFile
-//			cs.nextUploadFile = ""
-//			if err := os.Remove(deleteFile); err != nil {
-//				log.Println(err)
-//				return
-//			}
-//
-//		}()
-//	}
-//
-//	return nil
-//}
-//
-//// NewCloudStorage creates a new CloudStorage instance with the given configuration and CloudWriter
-//func NewCloudStorage(name string, interval time.Duration, cfg *config.Config, cloud CloudWriter) *CloudStorage {
-//	localPath := fmt.Sprintf("/tmp/%s", name)
-//	return &CloudStorage{LocalWriter: NewLocalWriter(localPath, interval), writer: cloud}
-//}
-//
-//type LocalWriter struct {
-//	name         string
-//	outfile      string
-//	dst          av.MuxCloser
-//	duration     time.Duration
-//	nextRotation time.Time
-//	now          time.Time
-//	streams      []av.CodecData
-//}
-//
-//func (lw *LocalWriter) Open(streams []av.CodecData) error {
-//	// Create timestamp for the current time
-//	lw.now = time.Now().UTC()
-//	lw.outfile = lw.filename(lw.name, lw.now)
-//
-//	// Set streams
-//	if streams != nil {
-//		lw.streams = streams
-//	}
-//
-//	dst, err := avutil.Create(lw.outfile)
-//	if err != nil {
-//		return errors.Wrap(err, "error creating dest")
-//	}
-//	lw.dst = dst
-//
-//	if err := lw.dst.WriteHeader(lw.streams); err != nil {
-//		return errors.Wrap(err, "error writing header for local writer")
-//	}
-//
-//	return nil
-//}
-//
-//// Rotate closes the local writer and reopens it at the current time
-//func (lw *LocalWriter) rotate() error {
-//	if err := lw.Close(); err != nil {
-//		return errors.Wrap(err, "rotate: error closing local writer")
-//	}
-//
-//	if err := lw.Open(nil); err != nil {
-//		return errors.Wrap(err, "rotate: error opening new local writer")
-//	}
-//
-//	lw.nextRotation = time.Now().UTC().Add(lw.duration)
-//
-//	return nil
-//}
-//
-//func (lw *LocalWriter) filename(name string, t time.Time) string {
-//	return fmt.Sprintf("%s-%d-%d-%d-%d-%d.mp4", name, t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute())
-//}
-//
-//func (lw *LocalWriter) Close() error {
-//	if err := lw.dst.WriteTrailer(); err != nil {
-//		return errors.Wrap(err, "error writing trailer to local writer")
-//	}
-//	if err := lw.dst.Close(); err != nil {
-//		return errors.Wrap(err, "error closing local writer")
-//	}
-//
-//	return nil
-//}
-//
-//func (lw *LocalWriter) Write(pkt av.Packet) error {
-//	if err := lw.dst.WritePacket(pkt); err != nil {
-//		return errors.Wrap(err, "error writing packet to local writer")
-//	}
-//
-//	if lw.nextRotation.Before(time.Now().UTC()) {
-//		log.Println("Time to rotate")
-//		if err := lw.rotate(); err != nil {
-//			log.Println(errors.Wrap(err, "error rotating"))
-//		}
-//	}
-//
-//	return nil
-//}
-//
-//// NewLocalWriter creates a new writer for storing videos locally
-//func NewLocalWriter(name string, interval time.Duration) *LocalWriter {
-//	return &LocalWriter{name: name, duration: interval, nextRotation: time.Now().UTC().Add(interval)}
-//
-//}
-//
+// CloudWriter defines the interface for writing files to cloud providers
+type CloudWriter interface {
+	UploadFile(r io.ReadCloser, key string) error
+}
+
+const (
+	// initial delay before retrying a failed upload
+	uploadRetryMin = 5 * time.Second
+
+	// maximum delay between upload retries
+	uploadRetryMax = 5 * time.Minute
+)
+
+// CloudStorage records segments locally and uploads each completed segment
+// to a cloud provider. Local files are removed once the upload succeeds;
+// failed uploads are retried with backoff unless retrying can't help.
+type CloudStorage struct {
+	*LocalWriter
+	writer CloudWriter
+
+	// completed segments waiting to be uploaded, oldest first
+	pendingMu sync.Mutex
+	pending   []*Segment
+
+	// signals the uploader that a segment was queued
+	wake chan struct{}
+
+	// queues segments left by a previous run with the first Open
+	start sync.Once
+
+	// closed by Close, the uploader exits once the queue is empty. Nil
+	// while no uploader is running.
+	stopMu sync.Mutex
+	stop   chan struct{}
+}
+
+// permanentError marks upload errors retrying won't fix, e.g. a local file
+// that can't be read
+type permanentError struct {
+	error
+}
+
+// Open prepares the local writer and starts uploading completed segments.
+// Segments left on disk by a previous run are queued for upload first.
+func (cs *CloudStorage) Open(video *gmf.Stream, audio *gmf.Stream) error {
+	if err := cs.LocalWriter.Open(video, audio); err != nil {
+		return errors.Wrap(err, "error opening local writer")
+	}
+
+	cs.stopMu.Lock()
+	if cs.stop == nil {
+		cs.stop = make(chan struct{})
+		go cs.upload(cs.stop)
+	}
+	cs.stopMu.Unlock()
+
+	cs.start.Do(func() {
+		pending, err := cs.LocalWriter.Segments()
+		if err != nil {
+			log.Println(errors.Wrap(err, "error listing pending segments"))
+		}
+
+		for _, seg := range pending {
+			cs.enqueue(seg)
+		}
+	})
+
+	return nil
+}
+
+// Close finalizes the segment being recorded and stops the uploader once
+// it has uploaded the queued segments. Open starts a new one.
+func (cs *CloudStorage) Close() error {
+	err := cs.LocalWriter.Close()
+
+	cs.stopMu.Lock()
+	if cs.stop != nil {
+		close(cs.stop)
+		cs.stop = nil
+	}
+	cs.stopMu.Unlock()
+
+	return err
+}
+
+// enqueue schedules a completed segment for upload
+func (cs *CloudStorage) enqueue(seg *Segment) {
+	cs.pendingMu.Lock()
+	cs.pending = append(cs.pending, seg)
+	cs.pendingMu.Unlock()
+
+	select {
+	case cs.wake <- struct{}{}:
+	default:
+	}
+}
+
+// requeue puts back a segment the uploader gave up on when it was stopped
+func (cs *CloudStorage) requeue(seg *Segment) {
+	cs.pendingMu.Lock()
+	cs.pending = append([]*Segment{seg}, cs.pending...)
+	cs.pendingMu.Unlock()
+}
+
+// next removes the oldest queued segment, or returns nil if there is none
+func (cs *CloudStorage) next() *Segment {
+	cs.pendingMu.Lock()
+	defer cs.pendingMu.Unlock()
+
+	if len(cs.pending) == 0 {
+		return nil
+	}
+
+	seg := cs.pending[0]
+	cs.pending[0] = nil
+	cs.pending = cs.pending[1:]
+
+	return seg
+}
+
+// upload uploads queued segments one at a time, retrying each until it
+// succeeds or fails permanently. Once stop is closed it returns when the
+// queue is empty, or puts back a segment that is waiting for a retry.
+func (cs *CloudStorage) upload(stop chan struct{}) {
+	for {
+		seg := cs.next()
+		if seg == nil {
+			select {
+			case <-cs.wake:
+				continue
+			case <-stop:
+				return
+			}
+		}
+
+		delay := uploadRetryMin
+		for {
+			err := cs.uploadSegment(seg)
+			if err == nil {
+				break
+			}
+
+			if _, ok := errors.Cause(err).(permanentError); ok {
+				log.Println(errors.Wrapf(err, "error uploading %s, giving up", seg.Path))
+				break
+			}
+
+			log.Println(errors.Wrapf(err, "error uploading %s, retrying in %s", seg.Path, delay))
+			select {
+			case <-time.After(delay):
+			case <-stop:
+				cs.requeue(seg)
+				return
+			}
+
+			delay *= 2
+			if delay > uploadRetryMax {
+				delay = uploadRetryMax
+			}
+		}
+	}
+}
+
+// uploadSegment uploads a single segment and removes the local copy once
+// the upload has been confirmed.
+func (cs *CloudStorage) uploadSegment(seg *Segment) error {
+	// removed locally, e.g. by a retention policy
+	if _, err := os.Stat(seg.Path); os.IsNotExist(err) {
+		log.Printf("%s no longer exists, skipping upload\n", seg.Path)
+		return nil
+	}
+
+	// segments left over from a previous run haven't been checksummed
+	if seg.Checksum == "" {
+		if err := seg.Stat(); err != nil {
+			return permanentError{err}
+		}
+	}
+
+	f, err := os.Open(seg.Path)
+	if err != nil {
+		return permanentError{errors.Wrapf(err, "error opening %s", seg.Path)}
+	}
+
+	err = cs.writer.UploadFile(f, seg.Key())
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(seg.Path); err != nil {
+		log.Println(errors.Wrapf(err, "error removing %s", seg.Path))
+	}
+
+	if cs.catalog != nil {
+		if err := cs.catalog.Uploaded(seg, seg.Key()); err != nil {
+			log.Println(errors.Wrapf(err, "error cataloging upload of %s", seg.Path))
+		}
+	}
+
+	return nil
+}
+
+// NewCloudStorage creates a new CloudStorage instance that stages segments
+// under dir before uploading them with the given CloudWriter.
+func NewCloudStorage(name string, dir string, interval time.Duration, cloud CloudWriter) *CloudStorage {
+	cs := &CloudStorage{
+		LocalWriter: NewLocalWriter(name, dir, interval),
+		writer:      cloud,
+		wake:        make(chan struct{}, 1),
+	}
+	cs.LocalWriter.completed = cs.enqueue
+
+	return cs
+}
+
+// LocalWriter remuxes encoded packets into MP4 segments on local disk
+// without re-encoding, rotating to a new segment every interval. Segments
+// are fragmented by default so they stay playable after a crash.
+type LocalWriter struct {
+	mu sync.Mutex
+
+	name     string
+	dir      string
+	duration time.Duration
+
+	// write fragmented MP4
+	fragmented bool
+
+	// source stream packets are copied from
+	ist *gmf.Stream
+
+	// optional source audio stream, transcoded to AAC when MP4 can't hold
+	// its codec
+	audio      *gmf.Stream
+	transcoder *audioTranscoder
+
+	// current segment
+	outfile      string
+	dst          *gmf.FmtCtx
+	ost          *gmf.Stream
+	aost         *gmf.Stream
+	nextRotation time.Time
+	now          time.Time
+
+	// timestamp of the first packet in the segment, in the source time base
+	offset int64
+
+	// timestamp of the last packet written, relative to offset
+	last int64
+
+	// name of the source codec
+	codec string
+
+	// called with each finalized segment
+	completed func(seg *Segment)
+
+	// optional catalog of recorded segments
+	catalog SegmentCatalog
+
+	// segments being finished in the background
+	finishing sync.WaitGroup
+}
+
+// Open prepares the writer to copy packets from the given source streams.
+// The first segment is created when the first keyframe arrives.
+func (lw *LocalWriter) Open(video *gmf.Stream, audio *gmf.Stream) error {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	if err := os.MkdirAll(lw.dir, 0755); err != nil {
+		return errors.Wrapf(err, "error creating %s", lw.dir)
+	}
+
+	lw.ist = video
+	lw.codec = codecName(video)
+
+	if lw.transcoder != nil {
+		lw.transcoder.Close()
+		lw.transcoder = nil
+	}
+
+	lw.audio = audio
+	if audio != nil && needsTranscode(audio) {
+		transcoder, err := newAudioTranscoder(audio)
+		if err != nil {
+			// keep recording video
+			log.Println(errors.Wrapf(err, "error setting up audio transcoding for %s, recording without audio", lw.name))
+			lw.audio = nil
+		}
+		lw.transcoder = transcoder
+	}
+
+	return nil
+}
+
+// openSegment creates a new segment starting at the current time
+func (lw *LocalWriter) openSegment() error {
+	lw.now = time.Now().UTC()
+	lw.outfile = lw.filename(lw.name, lw.now)
+
+	var opts []gmf.Option
+	if lw.fragmented {
+		// write an empty moov up front and a self-contained fragment at
+		// every keyframe, flushing each packet so a crash only loses the
+		// fragment in progress
+		opts = []gmf.Option{
+			{Key: "movflags", Val: "frag_keyframe+empty_moov+default_base_moof"},
+			{Key: "flush_packets", Val: 1},
+		}
+	}
+
+	dst, err := gmf.NewOutputCtx(lw.outfile, opts)
+	if err != nil {
+		return errors.Wrapf(err, "error creating %s", lw.outfile)
+	}
+
+	ost := dst.NewStream(nil)
+	if ost == nil {
+		dst.Free()
+		return errors.Errorf("error creating output stream for %s", lw.outfile)
+	}
+
+	if err := ost.CopyCodecPar(lw.ist.GetCodecPar()); err != nil {
+		dst.Free()
+		return errors.Wrap(err, "error copying codec parameters")
+	}
+	ost.SetTimeBase(lw.ist.TimeBase().AVR())
+
+	aost, err := lw.addAudioStream(dst)
+	if err != nil {
+		dst.Free()
+		return err
+	}
+
+	if err := dst.WriteHeader(); err != nil {
+		dst.Free()
+		return errors.Wrap(err, "error writing header for local writer")
+	}
+
+	lw.dst = dst
+	lw.ost = ost
+	lw.aost = aost
+	lw.offset = NoPTS
+	lw.last = 0
+	lw.nextRotation = lw.now.Add(lw.duration)
+
+	return nil
+}
+
+// closeSegment finalizes the current segment, if any
+func (lw *LocalWriter) closeSegment() error {
+	if lw.dst == nil {
+		return nil
+	}
+
+	lw.dst.WriteTrailer()
+	lw.dst.Free()
+	lw.dst = nil
+	lw.ost = nil
+	lw.aost = nil
+
+	seg := &Segment{Camera: lw.name, Path: lw.outfile, Start: lw.now, Codec: lw.codec}
+	if lw.last > 0 {
+		tb := lw.ist.TimeBase().AVR()
+		seg.End = seg.Start.Add(time.Duration(float64(lw.last) * float64(tb.Num) / float64(tb.Den) * float64(time.Second)))
+	} else {
+		seg.End = time.Now().UTC()
+	}
+
+	lw.finishing.Add(1)
+	go func() {
+		defer lw.finishing.Done()
+		lw.finish(seg)
+	}()
+
+	return nil
+}
+
+// finish checksums a finalized segment and hands it to the catalog and
+// completion hook
+func (lw *LocalWriter) finish(seg *Segment) {
+	if err := seg.Stat(); err != nil {
+		log.Println(errors.Wrap(err, "error reading finalized segment"))
+	}
+
+	if lw.catalog != nil {
+		if err := lw.catalog.Recorded(seg); err != nil {
+			log.Println(errors.Wrapf(err, "error cataloging %s", seg.Path))
+		}
+	}
+
+	if lw.completed != nil {
+		lw.completed(seg)
+	}
+}
+
+// addAudioStream adds a stream for the source's audio to a new segment, or
+// returns nil if audio isn't recorded
+func (lw *LocalWriter) addAudioStream(dst *gmf.FmtCtx) (*gmf.Stream, error) {
+	if lw.audio == nil {
+		return nil, nil
+	}
+
+	if lw.transcoder != nil {
+		enc := lw.transcoder.Encoder()
+		aost, err := dst.AddStreamWithCodeCtx(enc)
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating audio stream")
+		}
+		aost.SetTimeBase(enc.TimeBase().AVR())
+
+		return aost, nil
+	}
+
+	aost := dst.NewStream(nil)
+	if aost == nil {
+		return nil, errors.Errorf("error creating audio stream for %s", lw.outfile)
+	}
+
+	if err := aost.CopyCodecPar(lw.audio.GetCodecPar()); err != nil {
+		return nil, errors.Wrap(err, "error copying audio codec parameters")
+	}
+	aost.SetTimeBase(lw.audio.TimeBase().AVR())
+
+	return aost, nil
+}
+
+// Rotate closes the current segment and opens a new one at the current time
+func (lw *LocalWriter) rotate() error {
+	if err := lw.closeSegment(); err != nil {
+		return errors.Wrap(err, "rotate: error closing local writer")
+	}
+
+	if err := lw.openSegment(); err != nil {
+		return errors.Wrap(err, "rotate: error opening new local writer")
+	}
+
+	return nil
+}
+
+// SetCatalog sets the catalog finalized segments are recorded in
+func (lw *LocalWriter) SetCatalog(catalog SegmentCatalog) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	lw.catalog = catalog
+}
+
+// SetFragmented switches between fragmented and regular MP4 segments. It
+// takes effect with the next segment.
+func (lw *LocalWriter) SetFragmented(fragmented bool) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	lw.fragmented = fragmented
+}
+
+func (lw *LocalWriter) filename(name string, t time.Time) string {
+	return filepath.Join(lw.dir, fmt.Sprintf("%s-%s%s", name, t.Format(segmentNameFormat), segmentExt))
+}
+
+// Segments returns the finalized segments currently on disk, oldest first.
+// The segment being recorded is excluded.
+func (lw *LocalWriter) Segments() ([]*Segment, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	all, err := ListSegments(lw.dir, lw.name)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []*Segment
+	for _, seg := range all {
+		if lw.dst != nil && seg.Path == lw.outfile {
+			continue
+		}
+		segments = append(segments, seg)
+	}
+
+	return segments, nil
+}
+
+// Close finalizes the current segment and waits until finalized segments
+// are cataloged
+func (lw *LocalWriter) Close() error {
+	lw.mu.Lock()
+	err := lw.closeSegment()
+	lw.mu.Unlock()
+
+	lw.finishing.Wait()
+
+	return err
+}
+
+// WritePacket copies an encoded packet into the current segment. Segments
+// always begin on a keyframe so every file is independently playable.
+func (lw *LocalWriter) WritePacket(pkt *gmf.Packet) error {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	if lw.ist == nil {
+		return errors.New("local writer is not open")
+	}
+
+	if lw.audio != nil && pkt.StreamIndex() == lw.audio.Index() {
+		return lw.writeAudio(pkt)
+	}
+
+	if pkt.StreamIndex() != lw.ist.Index() {
+		return nil
+	}
+
+	keyframe := pkt.Flags()&PktFlagKey != 0
+	if lw.dst == nil && !keyframe {
+		// wait for a keyframe before starting a segment
+		return nil
+	}
+
+	if keyframe && (lw.dst == nil || lw.nextRotation.Before(time.Now().UTC())) {
+		if err := lw.rotate(); err != nil {
+			return errors.Wrap(err, "error rotating")
+		}
+	}
+
+	out := pkt.Clone()
+	defer out.Free()
+
+	if lw.offset == NoPTS {
+		lw.offset = out.Dts()
+		if lw.offset == NoPTS {
+			lw.offset = out.Pts()
+		}
+	}
+
+	if out.Pts() != NoPTS {
+		out.SetPts(out.Pts() - lw.offset)
+	}
+	if out.Dts() != NoPTS {
+		out.SetDts(out.Dts() - lw.offset)
+		if end := out.Dts() + out.Duration(); end > lw.last {
+			lw.last = end
+		}
+	}
+
+	gmf.RescaleTs(out, lw.ist.TimeBase(), lw.ost.TimeBase())
+	out.SetStreamIndex(lw.ost.Index())
+
+	if err := lw.dst.WritePacket(out); err != nil {
+		return errors.Wrap(err, "error writing packet to local writer")
+	}
+
+	return nil
+}
+
+// writeAudio copies or transcodes an audio packet into the current segment.
+// Audio from before the segment's first video packet is dropped.
+func (lw *LocalWriter) writeAudio(pkt *gmf.Packet) error {
+	if lw.dst == nil || lw.aost == nil || lw.offset == NoPTS {
+		return nil
+	}
+
+	if lw.transcoder == nil {
+		out := pkt.Clone()
+		defer out.Free()
+
+		return lw.writeShifted(out, lw.audio.TimeBase())
+	}
+
+	packets, err := lw.transcoder.Transcode(pkt)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range packets {
+		if err == nil {
+			err = lw.writeShifted(p, lw.transcoder.Encoder().TimeBase())
+		}
+		p.Free()
+	}
+
+	return err
+}
+
+// writeShifted moves an audio packet timestamped in tb onto the segment's
+// timeline and writes it
+func (lw *LocalWriter) writeShifted(out *gmf.Packet, tb gmf.AVRational) error {
+	offset := gmf.RescaleQ(lw.offset, lw.ist.TimeBase(), tb)
+	if out.Dts() != NoPTS && out.Dts() < offset {
+		return nil
+	}
+
+	if out.Pts() != NoPTS {
+		out.SetPts(out.Pts() - offset)
+	}
+	if out.Dts() != NoPTS {
+		out.SetDts(out.Dts() - offset)
+	}
+
+	gmf.RescaleTs(out, tb, lw.aost.TimeBase())
+	out.SetStreamIndex(lw.aost.Index())
+
+	return errors.Wrap(lw.dst.WritePacket(out), "error writing audio packet to local writer")
+}
+
+// NewLocalWriter creates a new writer for storing videos locally. Segments
+// are written to a directory named after the camera under dir.
+func NewLocalWriter(name string, dir string, interval time.Duration) *LocalWriter {
+	return &LocalWriter{name: name, dir: SegmentDir(dir, name), duration: interval, fragmented: true}
+}
+
+// stillInterval is the minimum time between stills
+const stillInterval = time.Second
+
+// StillWriter encodes the newest frame as a still at most once per
+// interval. The encoder and scaler are kept between stills and rebuilt
+// whenever the source is reopened.
 type StillWriter struct {
+	mu sync.Mutex
+
 	// FFmpeg decoder
 	//videoDecoder *ffmpeg.VideoDecoder
 	codecCtx *gmf.CodecCtx
@@ -196,7 +680,15 @@ type StillWriter struct {
 	// Still channel
 	stills chan *Still
 
-	lastStill int64
+	interval  time.Duration
+	lastStill time.Time
+
+	// format, quality and size of stills
+	options StillOptions
+
+	// scaling and still encoding
+	swsCtx *gmf.SwsCtx
+	encCtx *gmf.CodecCtx
 }
 
 //func (sw *StillWriter) Open(streams []av.CodecData) error {
@@ -204,62 +696,102 @@ type StillWriter struct {
 //}
 
 func (sw *StillWriter) SetCodecContext(ctx *gmf.CodecCtx) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
 	sw.codecCtx = ctx
+	sw.release()
+
 	return nil
 }
 
 func (sw *StillWriter) SetTimeBase(tb gmf.AVRational) {
-	sw.timebase = tb
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
 
+	sw.timebase = tb
 }
 
+// Close frees the encoder and scaler, they are rebuilt with the next still
 func (sw *StillWriter) Close() error {
-	return nil
-}
-
-func (sw *StillWriter) Write(frames []*gmf.Frame) error {
-	codec, err := gmf.FindEncoder("png")
-	if err != nil {
-		return errors.Wrap(err, "error finding encoder")
-	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
 
-	cc := gmf.NewCodecCtx(codec)
-	defer gmf.Release(cc)
+	sw.release()
 
-	cc.SetTimeBase(sw.timebase.AVR())
-	cc.SetPixFmt(
-		gmf.AV_PIX_FMT_RGB24).SetWidth(
-		sw.codecCtx.Width()).SetHeight(sw.codecCtx.Height())
+	return nil
+}
 
-	if codec.IsExperimental() {
-		cc.SetStrictCompliance(gmf.FF_COMPLIANCE_EXPERIMENTAL)
-	}
+// open creates the scaler and encoder for the current source
+func (sw *StillWriter) open() error {
+	width, height := fitSize(sw.codecCtx.Width(), sw.codecCtx.Height(), sw.options.MaxWidth, sw.options.MaxHeight)
 
-	if err := cc.Open(nil); err != nil {
-		return errors.Wrap(err, "error opening codec")
+	cc, err := newStillEncoder(sw.options, width, height, sw.timebase)
+	if err != nil {
+		return err
 	}
 
-	var swsCtx *gmf.SwsCtx
-	if swsCtx, err = gmf.NewSwsCtx(
+	swsCtx, err := gmf.NewSwsCtx(
 		sw.codecCtx.Width(),
 		sw.codecCtx.Height(),
 		sw.codecCtx.PixFmt(),
 		cc.Width(),
 		cc.Height(),
 		cc.PixFmt(),
-		gmf.SWS_BICUBIC); err != nil {
+		gmf.SWS_BICUBIC)
+	if err != nil {
+		gmf.Release(cc)
 		return errors.Wrap(err, "error create sws ctx")
 	}
 
-	defer swsCtx.Free()
+	sw.encCtx = cc
+	sw.swsCtx = swsCtx
 
-	if frames, err = gmf.DefaultRescaler(swsCtx, frames); err != nil {
-		return  errors.Wrap(err, "error rescaling")
+	return nil
+}
+
+// release frees the scaler and encoder
+func (sw *StillWriter) release() {
+	if sw.swsCtx != nil {
+		sw.swsCtx.Free()
+		sw.swsCtx = nil
 	}
 
-	packets, err := cc.Encode(frames, 0)
+	if sw.encCtx != nil {
+		gmf.Release(sw.encCtx)
+		sw.encCtx = nil
+	}
+}
+
+// Write encodes the newest of frames unless a still was produced less than
+// an interval ago, the still is stamped with the current time
+func (sw *StillWriter) Write(frames []*gmf.Frame) error {
+	return sw.WriteTimed(frames, time.Now())
+}
+
+// WriteTimed encodes the newest of frames read from the source at read
+// unless a still was read less than an interval before
+func (sw *StillWriter) WriteTimed(frames []*gmf.Frame, read time.Time) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if len(frames) == 0 || read.Sub(sw.lastStill) < sw.interval {
+		return nil
+	}
+
+	if sw.codecCtx == nil {
+		return errors.New("still writer has no codec context")
+	}
+
+	if sw.encCtx == nil {
+		if err := sw.open(); err != nil {
+			return err
+		}
+	}
+
+	packets, err := scaleAndEncode(sw.encCtx, sw.swsCtx, sw.options, frames[len(frames)-1])
 	if err != nil {
-		return errors.Wrap(err, "error encoding")
+		return err
 	}
 
 	if len(packets) == 0 {
@@ -267,18 +799,16 @@ func (sw *StillWriter) Write(frames []*gmf.Frame) error {
 	}
 
 	for _, p := range packets {
-		now := time.Now().Unix()
-		if sw.lastStill == 0 {
-			sw.lastStill = now
+		sw.stills <- &Still{
+			imgData:     p.Data(),
+			contentType: sw.options.ContentType(),
+			time:        read,
+			width:       sw.encCtx.Width(),
+			height:      sw.encCtx.Height(),
 		}
-		if time.Duration(now-sw.lastStill) > time.Second {
-			continue
-		}
-		sw.lastStill = now
-
-		sw.stills <- &Still{imgData: p.Data()}
 		p.Free()
 	}
+	sw.lastStill = read
 
 	//frame, err := sw.videoDecoder.Decode(pkt.Data)
 	//
@@ -313,13 +843,17 @@ func (sw *StillWriter) encodeStill(img image.Image) {
 	var b bytes.Buffer
 	jpeg.Encode(&b, img, nil)
 
-	sw.stills <- &Still{b.Bytes()}
+	sw.stills <- &Still{imgData: b.Bytes(), contentType: "image/jpeg", time: time.Now()}
 
 }
 
 //NewStillWriter creates a writer for passing still images through a channel for
 //consumption.
-func NewStillWriter(ch chan *Still) (*StillWriter, error) {
+func NewStillWriter(ch chan *Still, options StillOptions) (*StillWriter, error) {
+	if _, ok := stillEncoders[options.Format]; !ok {
+		return nil, errors.Errorf("unknown still format %s", options.Format)
+	}
+
 	// get video stream from streams
 	//vstream, err := extractVideoStream(streams)
 	//if err != nil {
@@ -334,5 +868,5 @@ func NewStillWriter(ch chan *Still) (*StillWriter, error) {
 	//	return nil, errors.Wrap(err, "error setting up video decoder")
 	//}
 
-	return &StillWriter{stills: ch}, nil
+	return &StillWriter{stills: ch, interval: stillInterval, options: options}, nil
 }